@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 
 	"github.com/midbel/curly/internal/filters"
@@ -15,6 +16,19 @@ import (
 
 type FuncMap map[string]interface{}
 
+// ExecError is returned by Execute when the execution of a node fails. It
+// gives the position and the source of the failing tag and the list of exec,
+// partial and section calls that lead to it.
+type ExecError = parser.ExecError
+
+type Frame = parser.Frame
+
+// Renderer renders a template text against the current context. Lambdas are
+// data values of type func() string, func(string) string or
+// func(string, Renderer) (string, error). The last two are called with the
+// unparsed content of the section they are used with.
+type Renderer = parser.Renderer
+
 var Filters = FuncMap{
 	// strings filters
 	"split":  strings.Split,
@@ -69,31 +83,43 @@ var Filters = FuncMap{
 	// time function
 	"now": filters.Now,
 	// others
-	"len": filters.Len,
+	"len":  filters.Len,
+	"safe": safe,
 }
 
 type Template struct {
 	name      string
+	file      string
 	filters   FuncMap
+	formats   map[reflect.Type]state.Formatter
 	root      parser.Node
 	templates map[string]*Template
+	missing   state.MissingKey
+	escaper   Escaper
+	mode      parser.Mode
+	parents   []string
 }
 
 func New(name string) *Template {
 	return &Template{
 		name:      name,
 		filters:   make(FuncMap),
+		formats:   make(map[reflect.Type]state.Formatter),
 		templates: make(map[string]*Template),
 	}
 }
 
+// New allocates a new template associated with t and sharing its options. The
+// new template can be executed with ExecuteTemplate or included as a partial
+// by the other templates associated with t.
+func (t *Template) New(name string) *Template {
+	tpl := t.sub(name)
+	t.templates[name] = tpl
+	return tpl
+}
+
 func ParseFile(file string) (*Template, error) {
-	r, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-	return New(filepath.Base(file)).Parse(r)
+	return New(filepath.Base(file)).parseFile(file)
 }
 
 func Parse(r io.Reader) (*Template, error) {
@@ -101,14 +127,84 @@ func Parse(r io.Reader) (*Template, error) {
 }
 
 func (t *Template) Parse(r io.Reader) (*Template, error) {
-	node, err := parser.Parse(r)
+	node, err := parser.ParseMode(t.name, r, t.mode)
 	if err != nil {
 		return nil, err
 	}
 	t.root = node
+	if err := t.inherit(); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
+func (t *Template) parseFile(file string) (*Template, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	t.file = filepath.Clean(file)
+	if e := escaperFor(file); e != nil {
+		t.escaper = e
+	}
+	return t.Parse(r)
+}
+
+// inherit replaces the root of t by the root of the template it extends (if
+// any) where the sections of the parent are overridden by the ones of t.
+func (t *Template) inherit() error {
+	root, ok := t.root.(*parser.RootNode)
+	if !ok || root.Extends == "" {
+		return nil
+	}
+	parent, err := t.lookup(root.Extends)
+	if err != nil {
+		return err
+	}
+	other, ok := parent.root.(*parser.RootNode)
+	if !ok {
+		return fmt.Errorf("%s: template can not be extended", root.Extends)
+	}
+	node, err := root.Inherit(other)
+	if err != nil {
+		return err
+	}
+	t.root = node
+	return nil
+}
+
+func (t *Template) lookup(name string) (*Template, error) {
+	if tpl, ok := t.templates[name]; ok {
+		return tpl, nil
+	}
+	file := name
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(t.file), file)
+	}
+	file = filepath.Clean(file)
+	for _, p := range append(t.parents, t.file) {
+		if p == file {
+			return nil, fmt.Errorf("%s: circular extends", name)
+		}
+	}
+	tpl := t.sub(filepath.Base(file))
+	tpl.parents = append(t.parents, t.file)
+	return tpl.parseFile(file)
+}
+
+// sub creates a new template sharing the templates and the options of t.
+func (t *Template) sub(name string) *Template {
+	tpl := New(name)
+	tpl.templates = t.templates
+	tpl.filters = t.filters
+	tpl.formats = t.formats
+	tpl.missing = t.missing
+	tpl.escaper = t.escaper
+	tpl.mode = t.mode
+	return tpl
+}
+
 func (t *Template) Funcs(fm FuncMap) *Template {
 	for k, f := range fm {
 		t.filters[k] = f
@@ -116,27 +212,145 @@ func (t *Template) Funcs(fm FuncMap) *Template {
 	return t
 }
 
+// Formatters registers functions giving the string representation of values of
+// a given type. They take precedence over the default representation of values.
+// Nil pointers are given to the formatter registered for the pointer type.
+//
+// Formatters are shared with the templates associated with t.
+func (t *Template) Formatters(fm map[reflect.Type]func(reflect.Value) (string, error)) *Template {
+	for k, f := range fm {
+		t.formats[k] = f
+	}
+	return t
+}
+
+// Escaper sets the escaper used for the values written by t. Templates loaded
+// from files use the escaper given by the extension of the file (.html, .json,
+// .sh, .yaml, .sql, .tex, ...) and the escaper of t otherwise, like .txt files
+// that are HTML escaped by default.
+func (t *Template) Escaper(e Escaper) *Template {
+	t.escaper = e
+	return t
+}
+
+// Option sets options for the template. Options are given as key=value strings.
+// Known options are:
+//
+//	missingkey=default or missingkey=invalid
+//		unresolved keys are silently rendered as nothing (the default).
+//	missingkey=zero
+//		unresolved keys of a map are rendered as the zero value of the map
+//		element type.
+//	missingkey=error
+//		execution stops with an error giving the position of the key.
+//	syntax=curly
+//		templates are parsed with the curly syntax (the default).
+//	syntax=mustache
+//		templates are parsed following the Mustache specification: {{< name}}
+//		includes a parent template whose {{$ name}} blocks can be overridden.
+//		Options must be set before parsing.
+//	indent=true
+//		the output of partials and exec tags standing alone on their line is
+//		indented like the tag (the default).
+//	indent=false
+//		the output of partials and exec tags is never indented. Options must
+//		be set before parsing.
+//	html=true
+//		values are escaped according to the HTML context where they appear:
+//		text, attribute values, URLs, scripts or styles. Templates where the
+//		context is ambiguous are rejected when parsed. Sections are escaped in
+//		the context of the section they override and blocks of Mustache
+//		parents can only be overridden in the context where they appear.
+//		Options must be set before parsing.
+//	html=false
+//		values are escaped with the escaper of the template (the default).
+//	escape=text|html|json|shell|yaml|sql|latex
+//		values are escaped with the given built-in escaper (html by default).
+//
+// Option panics if an option is unknown or invalid.
+func (t *Template) Option(opt ...string) *Template {
+	for _, o := range opt {
+		t.setOption(o)
+	}
+	return t
+}
+
+func (t *Template) setOption(opt string) {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		panic(fmt.Sprintf("%s: invalid option", opt))
+	}
+	key, value := parts[0], parts[1]
+	switch key {
+	case "missingkey":
+		switch value {
+		case "default", "invalid":
+			t.missing = state.MissingDefault
+		case "zero":
+			t.missing = state.MissingZero
+		case "error":
+			t.missing = state.MissingError
+		default:
+			panic(fmt.Sprintf("%s: invalid value for missingkey", value))
+		}
+	case "syntax":
+		switch value {
+		case "curly":
+			t.mode &^= parser.Mustache
+		case "mustache":
+			t.mode |= parser.Mustache
+		default:
+			panic(fmt.Sprintf("%s: invalid value for syntax", value))
+		}
+	case "indent":
+		switch value {
+		case "true":
+			t.mode &^= parser.NoIndent
+		case "false":
+			t.mode |= parser.NoIndent
+		default:
+			panic(fmt.Sprintf("%s: invalid value for indent", value))
+		}
+	case "escape":
+		e, ok := escapers[value]
+		if !ok {
+			panic(fmt.Sprintf("%s: invalid value for escape", value))
+		}
+		t.escaper = e
+	case "html":
+		switch value {
+		case "true":
+			t.mode |= parser.HTML
+		case "false":
+			t.mode &^= parser.HTML
+		default:
+			panic(fmt.Sprintf("%s: invalid value for html", value))
+		}
+	default:
+		panic(fmt.Sprintf("%s: unknown option", key))
+	}
+}
+
 func (t *Template) ParseFiles(files ...string) (*Template, error) {
 	if len(files) == 0 {
 		return t, nil
 	}
 	root, ok := t.root.(*parser.RootNode)
 	if !ok {
-		root := parser.RootNode{
+		root = &parser.RootNode{
 			Named: make(parser.Nodeset),
 		}
-		t.root = &root
+		t.root = root
 	}
 	for _, f := range files {
-		tpl, err := ParseFile(f)
-		if err != nil {
+		tpl := t.sub(filepath.Base(f))
+		if _, err := tpl.parseFile(f); err != nil {
 			return nil, err
 		}
-		base := filepath.Base(f)
 		if other, ok := tpl.root.(*parser.RootNode); ok {
 			root.Named.Merge(other.Named)
 		}
-		t.templates[base] = tpl
+		t.templates[tpl.name] = tpl
 	}
 	return t, nil
 }
@@ -149,10 +363,35 @@ func (t *Template) Execute(w io.Writer, data interface{}) error {
 		r, ok = t.root.(*parser.RootNode)
 	)
 	if ok {
-		set = r.Named
+		set = t.partials(r.Named)
+	}
+	var (
+		filters = state.FuncMap(t.filters)
+		options = state.Options{
+			Missing:    t.missing,
+			Formatters: t.formats,
+			Escaper:    t.escaper,
+		}
+	)
+	return r.Execute(wr, set, state.NewState(data, filters, options))
+}
+
+// partials gives a copy of named where the templates loaded by ParseFiles are
+// registered as partials under their name with and without extension.
+func (t *Template) partials(named parser.Nodeset) parser.Nodeset {
+	set := make(parser.Nodeset)
+	for k, tpl := range t.templates {
+		if tpl.root == nil {
+			continue
+		}
+		set.RegisterPartial(k, tpl.root)
+		if ext := filepath.Ext(k); ext != "" {
+			if set.Partial(strings.TrimSuffix(k, ext)) == nil {
+				set.RegisterPartial(strings.TrimSuffix(k, ext), tpl.root)
+			}
+		}
 	}
-	filters := state.FuncMap(t.filters)
-	return r.Execute(wr, set, state.EmptyState(data, filters))
+	return set.Merge(named)
 }
 
 func (t *Template) ExecuteTemplate(name string, w io.Writer, data interface{}) error {
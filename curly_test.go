@@ -1,15 +1,19 @@
 package curly_test
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"testing"
+	"time"
 
 	"github.com/midbel/curly"
 )
 
-func ExampleTemplate_Define() {
+func ExampleTemplate_define() {
 	const demo = `
 {{< list }}
 {{- # character -}}
@@ -75,7 +79,7 @@ func ExampleTemplate_Define() {
 	// [[star wars: the empire strikes back]]
 }
 
-func ExampleTemplate_Block() {
+func ExampleTemplate_block() {
 	const demo = `
 {{! comment are not rendered }}
 {{< contact -}}
@@ -126,11 +130,10 @@ licence: MIT
 	// - curly (version: 0.0.1)
 	// - toml (version: 0.1.1)
 	//
-	// contact: midbel@foobar.org
-	// licence: MIT
+	// contact: midbel@foobar.orglicence: MIT
 }
 
-func ExampleTemplate_Filters() {
+func ExampleTemplate_filters() {
 	const demo = `
 repositories:
 {{# repo | reverse -}}
@@ -359,3 +362,393 @@ func ExampleTemplate_ParseFiles() {
 	//   - 2021-07-18 11:00:00: initial commit
 	//   - 2021-11-07 15:45:00: test parse files
 }
+
+func ExampleTemplate_extends() {
+	files := []struct {
+		File    string
+		Content string
+	}{
+		{
+			File: "base.txt",
+			Content: `
+{{-% header -}}
+== {{title}} ==
+{{/ header -}}
+{{% content -}}
+no content
+{{/ content -}}
+{{% footer -}}
+-- {{author}}
+{{/ footer -}}`,
+		},
+		{
+			File: "layout.txt",
+			Content: `
+{{- extends "base.txt" -}}
+{{% header -}}
+{{super -}}
+~~~~~~~~~~~
+{{/ header -}}`,
+		},
+		{
+			File: "page.txt",
+			Content: `
+{{- extends "layout.txt" -}}
+{{% content -}}
+{{ body }}
+{{/ content -}}
+{{% footer -}}
+{{super -}}
+-- generated by curly
+{{/ footer -}}`,
+		},
+	}
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		fmt.Println("mkdir tmp:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var list []string
+	for _, f := range files {
+		f.File = filepath.Join(dir, f.File)
+		buf := strings.TrimSpace(f.Content)
+		if err := os.WriteFile(f.File, []byte(buf), 0644); err != nil {
+			fmt.Println("writing file error:", err)
+			return
+		}
+		list = append(list, f.File)
+	}
+	t, err := curly.New("demo").ParseFiles(list...)
+	if err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	data := map[string]string{
+		"title":  "curly",
+		"body":   "mustache-like templates for go",
+		"author": "midbel",
+	}
+	t.ExecuteTemplate("page.txt", os.Stdout, data)
+	// Output:
+	// == curly ==
+	// ~~~~~~~~~~~
+	// mustache-like templates for go
+	// -- midbel
+	// -- generated by curly
+}
+
+func ExampleTemplate_lambda() {
+	const demo = `
+{{# bold }}{{ name }}{{/ bold }}
+{{# twice }}[{{ name }}]{{/ twice }}
+{{ greet }}
+`
+	data := map[string]interface{}{
+		"name": "curly",
+		"bold": func(str string) string {
+			return "**" + str + "**"
+		},
+		"twice": func(str string, render curly.Renderer) (string, error) {
+			str, err := render(str)
+			return strings.Repeat(str, 2), err
+		},
+		"greet": func() string {
+			return "hello {{ name }}"
+		},
+	}
+	t, err := curly.New("demo").Parse(strings.NewReader(demo))
+	if err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	t.Execute(os.Stdout, data)
+
+	// Output:
+	// **curly**
+	// [curly][curly]
+	// hello curly
+}
+
+func ExampleTemplate_Formatters() {
+	const (
+		entry = `{{ name }} started at {{ start }} and ran for {{ elapsed }} ({{ digest }})`
+		demo  = `{{# jobs }}{{> entry }}{{ owner }}
+{{/ jobs }}`
+	)
+	type Job struct {
+		Name    string        `curly:"name"`
+		Start   time.Time     `curly:"start"`
+		Elapsed time.Duration `curly:"elapsed"`
+		Digest  []byte        `curly:"digest"`
+		Owner   *string       `curly:"owner"`
+	}
+	var (
+		owner = " by midbel"
+		data  = map[string]interface{}{
+			"jobs": []Job{
+				{
+					Name:    "build",
+					Start:   time.Date(2021, 11, 7, 15, 45, 0, 0, time.UTC),
+					Elapsed: 90 * time.Second,
+					Digest:  []byte{0xca, 0xfe},
+					Owner:   &owner,
+				},
+				{
+					Name:    "test",
+					Start:   time.Date(2021, 11, 7, 15, 47, 0, 0, time.UTC),
+					Elapsed: 1500 * time.Millisecond,
+					Digest:  []byte{0xbe, 0xef},
+				},
+			},
+		}
+		formats = map[reflect.Type]func(reflect.Value) (string, error){
+			reflect.TypeOf(time.Time{}): func(v reflect.Value) (string, error) {
+				return v.Interface().(time.Time).Format("2006-01-02 15:04"), nil
+			},
+			reflect.TypeOf([]byte(nil)): func(v reflect.Value) (string, error) {
+				return hex.EncodeToString(v.Bytes()), nil
+			},
+			reflect.TypeOf((*string)(nil)): func(v reflect.Value) (string, error) {
+				if v.IsNil() {
+					return "", nil
+				}
+				return v.Elem().String(), nil
+			},
+		}
+	)
+	t := curly.New("demo").Formatters(formats)
+	if _, err := t.New("entry").Parse(strings.NewReader(entry)); err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	if _, err := t.Parse(strings.NewReader(demo)); err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	t.Execute(os.Stdout, data)
+
+	// Output:
+	// build started at 2021-11-07 15:45 and ran for 1m30s (cafe) by midbel
+	// test started at 2021-11-07 15:47 and ran for 1.5s (beef)
+}
+
+func ExampleTemplate_Escaper() {
+	const demo = `#!/bin/sh
+echo {{ message }}
+echo {{ file }}
+`
+	data := map[string]interface{}{
+		"message": "it's done",
+		"file":    "/tmp/output.txt",
+	}
+	t, err := curly.New("deploy.sh").Escaper(curly.ShellEscaper).Parse(strings.NewReader(demo))
+	if err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	t.Execute(os.Stdout, data)
+
+	// Output:
+	// #!/bin/sh
+	// echo 'it'\''s done'
+	// echo /tmp/output.txt
+}
+
+func TestTemplateEscape(t *testing.T) {
+	data := []struct {
+		Escape string
+		Input  string
+		Want   string
+	}{
+		{
+			Escape: "text",
+			Input:  `<b>{{ value }}</b>`,
+			Want:   `<b>a <'b'> & "c" $d_e#</b>`,
+		},
+		{
+			Escape: "html",
+			Input:  `<b>{{ value }}</b>`,
+			Want:   `<b>a &lt;&#39;b&#39;&gt; &amp; &#34;c&#34; $d_e#</b>`,
+		},
+		{
+			Escape: "json",
+			Input:  `{"value": "{{ value }}", "port": {{ port }}}`,
+			Want:   `{"value": "a <'b'> & \"c\" $d_e#", "port": 8080}`,
+		},
+		{
+			Escape: "shell",
+			Input:  `echo {{ value }} {{ port }}`,
+			Want:   `echo 'a <'\''b'\''> & "c" $d_e#' 8080`,
+		},
+		{
+			Escape: "yaml",
+			Input:  `{ value: {{ value }}, port: {{ port }} }`,
+			Want:   `{ value: "a <'b'> & \"c\" $d_e#", port: 8080 }`,
+		},
+		{
+			Escape: "yaml",
+			Input:  `[{{ answer }}, {{ empty }}, {{ version }}, {{ date }}, {{ flag }}, {{ ratio }}, {{ name }}]`,
+			Want:   `["yes", "null", "1.10", "2001-12-14", true, 0.5, curly]`,
+		},
+		{
+			Escape: "sql",
+			Input:  `SELECT {{ value }}`,
+			Want:   `SELECT 'a <''b''> & "c" $d_e#'`,
+		},
+		{
+			Escape: "latex",
+			Input:  `\emph{ {{ value }} }`,
+			Want:   `\emph{ a <'b'> \& "c" \$d\_e\# }`,
+		},
+	}
+	ctx := map[string]interface{}{
+		"value":   `a <'b'> & "c" $d_e#`,
+		"port":    8080,
+		"answer":  "yes",
+		"empty":   "null",
+		"version": "1.10",
+		"date":    "2001-12-14",
+		"flag":    true,
+		"ratio":   0.5,
+		"name":    "curly",
+	}
+	for _, d := range data {
+		tpl, err := curly.New(d.Escape).Option("escape=" + d.Escape).Parse(strings.NewReader(d.Input))
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing template: %s", d.Escape, err)
+			continue
+		}
+		var str strings.Builder
+		if err := tpl.Execute(&str, ctx); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Escape, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: results mismatched!\nwant %s\ngot  %s", d.Escape, d.Want, got)
+		}
+	}
+}
+
+func TestTemplateEscapeCapture(t *testing.T) {
+	const (
+		input = `{{: v | replace "X" user }}<p>X</p>{{/ v }}{{ v }}|{{: w }}<p>{{ user }}</p>{{/ w }}{{ w }}`
+		want  = `&lt;p&gt;&lt;script&gt;alert(1)&lt;/script&gt;&lt;/p&gt;|<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>`
+	)
+	ctx := map[string]interface{}{
+		"user": "<script>alert(1)</script>",
+	}
+	fns := curly.FuncMap{
+		"replace": strings.ReplaceAll,
+	}
+	for _, opt := range []string{"html=false", "html=true"} {
+		tpl, err := curly.New(opt).Funcs(fns).Option(opt).Parse(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing template: %s", opt, err)
+			continue
+		}
+		var str strings.Builder
+		if err := tpl.Execute(&str, ctx); err != nil {
+			t.Errorf("%s: unexpected error: %s", opt, err)
+			continue
+		}
+		if got := str.String(); got != want {
+			t.Errorf("%s: results mismatched!\nwant %s\ngot  %s", opt, want, got)
+		}
+	}
+}
+
+func TestTemplateEscapeExtension(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		files = map[string]string{
+			"config.yml": "name: {{ name }}\n",
+			"run.sh":     "echo {{ name }}\n",
+			"page.tpl":   "<p>{{ name }}</p>\n",
+			"notes.txt":  "<p>{{ name }}</p>\n",
+		}
+		want = map[string]string{
+			"config.yml": "name: \"foo: <bar>\"\n",
+			"run.sh":     "echo 'foo: <bar>'\n",
+			"page.tpl":   "<p>foo: <bar></p>\n",
+			"notes.txt":  "<p>foo: <bar></p>\n",
+		}
+		list []string
+	)
+	for f, str := range files {
+		file := filepath.Join(dir, f)
+		if err := os.WriteFile(file, []byte(str), 0644); err != nil {
+			t.Fatalf("fail to write %s: %s", f, err)
+		}
+		list = append(list, file)
+	}
+	tpl, err := curly.New("").Escaper(curly.TextEscaper).ParseFiles(list...)
+	if err != nil {
+		t.Fatalf("unexpected error parsing files: %s", err)
+	}
+	for f := range files {
+		var str strings.Builder
+		if err := tpl.ExecuteTemplate(f, &str, map[string]string{"name": "foo: <bar>"}); err != nil {
+			t.Errorf("%s: unexpected error: %s", f, err)
+			continue
+		}
+		if got := str.String(); got != want[f] {
+			t.Errorf("%s: results mismatched! want %q, got %q", f, want[f], got)
+		}
+	}
+
+	tpl, err = curly.New("").ParseFiles(filepath.Join(dir, "notes.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing files: %s", err)
+	}
+	var str strings.Builder
+	if err := tpl.ExecuteTemplate("notes.txt", &str, map[string]string{"name": "foo: <bar>"}); err != nil {
+		t.Fatalf("notes.txt: unexpected error: %s", err)
+	}
+	if got, want := str.String(), "<p>foo: &lt;bar&gt;</p>\n"; got != want {
+		t.Errorf("notes.txt: results mismatched! want %q, got %q", want, got)
+	}
+}
+
+func ExampleSafe() {
+	const demo = `<h1>{{ title }}</h1>
+{{ body | markdown }}
+{{ footer | safe }}
+`
+	data := map[string]interface{}{
+		"title":  "curly & co",
+		"body":   "**mustache-like** templates",
+		"footer": "<hr/>",
+	}
+	markdown := func(str string) curly.Safe {
+		str = strings.Replace(str, "**", "<strong>", 1)
+		str = strings.Replace(str, "**", "</strong>", 1)
+		return curly.Safe("<p>" + str + "</p>")
+	}
+	t := curly.New("demo").Funcs(curly.Filters).Funcs(curly.FuncMap{"markdown": markdown})
+	if _, err := t.Parse(strings.NewReader(demo)); err != nil {
+		fmt.Println("error parsing template:", err)
+		return
+	}
+	t.Execute(os.Stdout, data)
+
+	// Output:
+	// <h1>curly &amp; co</h1>
+	// <p><strong>mustache-like</strong> templates</p>
+	// <hr/>
+}
+
+func TestTemplateNewFilters(t *testing.T) {
+	tpl := curly.New("a").Funcs(curly.Filters).Option("missingkey=error")
+	if _, err := tpl.New("b").Parse(strings.NewReader("{{ x | upper }}")); err != nil {
+		t.Fatalf("unexpected error parsing template: %s", err)
+	}
+	var str strings.Builder
+	if err := tpl.ExecuteTemplate("b", &str, map[string]string{"x": "foo"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := str.String(), "FOO"; got != want {
+		t.Errorf("results mismatched! want %s, got %s", want, got)
+	}
+}
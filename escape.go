@@ -0,0 +1,194 @@
+package curly
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/midbel/curly/internal/parser"
+	"github.com/midbel/curly/internal/state"
+)
+
+// Escaper escapes the string representation of the values written by the
+// variables of a template. Unescaped variables ({{& name }}) are written as is.
+type Escaper = state.Escaper
+
+// Safe is a string that is written as is instead of being escaped by the
+// escaper of the template. In templates with the html option, it is trusted
+// only where HTML is expected.
+type Safe = parser.Safe
+
+// SafeJS is a string that is written as is where a javascript value is expected
+// in templates with the html option.
+type SafeJS = parser.SafeJS
+
+// SafeURL is a string that is not filtered when written in a URL attribute in
+// templates with the html option.
+type SafeURL = parser.SafeURL
+
+func safe(str string) Safe {
+	return Safe(str)
+}
+
+// EscaperFunc is an adapter to use a function as an Escaper.
+type EscaperFunc func(string) string
+
+func (f EscaperFunc) Escape(str string) string {
+	return f(str)
+}
+
+var (
+	// TextEscaper writes values as is.
+	TextEscaper Escaper = EscaperFunc(func(str string) string { return str })
+	// HTMLEscaper escapes values for HTML text and quoted attributes. It is the
+	// default escaper.
+	HTMLEscaper Escaper = EscaperFunc(html.EscapeString)
+	// JSONEscaper escapes values for the content of a JSON string.
+	JSONEscaper Escaper = EscaperFunc(escapeJSON)
+	// ShellEscaper quotes values for a POSIX shell.
+	ShellEscaper Escaper = EscaperFunc(escapeShell)
+	// YAMLEscaper gives values as YAML scalars, double quoted if needed. Only
+	// numbers and booleans are written as YAML numbers and booleans.
+	YAMLEscaper Escaper = yamlEscaper{}
+	// SQLEscaper gives values as SQL string literals.
+	SQLEscaper Escaper = EscaperFunc(escapeSQL)
+	// LaTeXEscaper escapes the special characters of LaTeX.
+	LaTeXEscaper Escaper = EscaperFunc(latexEscaper.Replace)
+)
+
+var escapers = map[string]Escaper{
+	"text":  TextEscaper,
+	"html":  HTMLEscaper,
+	"json":  JSONEscaper,
+	"shell": ShellEscaper,
+	"yaml":  YAMLEscaper,
+	"sql":   SQLEscaper,
+	"latex": LaTeXEscaper,
+}
+
+// extensions gives the escaper of files according to their extension. Files
+// with other extensions (like .txt) use the escaper of the template.
+var extensions = map[string]string{
+	".html": "html",
+	".htm":  "html",
+	".xml":  "html",
+	".json": "json",
+	".sh":   "shell",
+	".bash": "shell",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".sql":  "sql",
+	".tex":  "latex",
+}
+
+// escaperFor gives the escaper to use for file according to its extension.
+func escaperFor(file string) Escaper {
+	ext := strings.ToLower(filepath.Ext(file))
+	if name, ok := extensions[ext]; ok {
+		return escapers[name]
+	}
+	return nil
+}
+
+func escapeJSON(str string) string {
+	var (
+		buf bytes.Buffer
+		enc = json.NewEncoder(&buf)
+	)
+	enc.SetEscapeHTML(false)
+	enc.Encode(str)
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(buf.String()), "\""), "\"")
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func escapeShell(str string) string {
+	if shellSafe.MatchString(str) {
+		return str
+	}
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+var (
+	yamlPlain    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./+-]*$`)
+	yamlNumber   = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?(e[-+]?[0-9]+)?$`)
+	yamlReplacer = strings.NewReplacer(
+		"\\", `\\`,
+		"\"", `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+		"\x00", `\0`,
+	)
+)
+
+// yamlKeywords are the plain scalars that YAML resolves to null or booleans.
+var yamlKeywords = map[string]struct{}{
+	"~":     {},
+	"null":  {},
+	"true":  {},
+	"false": {},
+	"yes":   {},
+	"no":    {},
+	"on":    {},
+	"off":   {},
+	"y":     {},
+	"n":     {},
+}
+
+type yamlEscaper struct{}
+
+func (yamlEscaper) Escape(str string) string {
+	return escapeYAML(str)
+}
+
+func (yamlEscaper) EscapeValue(value reflect.Value, str string) string {
+	switch value.Kind() {
+	case reflect.Bool:
+		if str == "true" || str == "false" {
+			return str
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if yamlNumber.MatchString(str) {
+			return str
+		}
+	}
+	return escapeYAML(str)
+}
+
+// escapeYAML gives str as a YAML string. Plain scalars that YAML would resolve
+// to something else than a string (null, booleans, numbers, dates) are quoted.
+func escapeYAML(str string) string {
+	if _, ok := yamlKeywords[strings.ToLower(str)]; !ok && yamlPlain.MatchString(str) && !isDigit(str[0]) {
+		return str
+	}
+	return "\"" + yamlReplacer.Replace(str) + "\""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func escapeSQL(str string) string {
+	str = strings.ReplaceAll(str, "\x00", "")
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
+
+var latexEscaper = strings.NewReplacer(
+	"\\", `\textbackslash{}`,
+	"{", `\{`,
+	"}", `\}`,
+	"$", `\$`,
+	"&", `\&`,
+	"#", `\#`,
+	"%", `\%`,
+	"_", `\_`,
+	"^", `\textasciicircum{}`,
+	"~", `\textasciitilde{}`,
+)
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/midbel/curly/internal/token"
 )
 
 func Debug(r io.Reader, w io.Writer) error {
@@ -28,7 +30,13 @@ func debugWithLevel(w io.Writer, n Node, level int) {
 	fmt.Fprint(w, prefix)
 	switch n := n.(type) {
 	case *RootNode:
-		fmt.Fprint(w, "template [")
+		fmt.Fprint(w, "template")
+		if n.Extends != "" {
+			fmt.Fprint(w, "(extends: ")
+			fmt.Fprint(w, n.Extends)
+			fmt.Fprint(w, ")")
+		}
+		fmt.Fprint(w, " [")
 		fmt.Fprintln(w)
 		for i := range n.Named {
 			debugWithLevel(w, n.Named[i], level+2)
@@ -68,18 +76,78 @@ func debugWithLevel(w io.Writer, n Node, level int) {
 		fmt.Fprint(w, "section(name: ")
 		fmt.Fprint(w, n.name)
 		fmt.Fprintln(w, ")")
+	case *SuperNode:
+		fmt.Fprint(w, "super(section: ")
+		fmt.Fprint(w, n.section.name)
+		fmt.Fprintln(w, ")")
+	case *ParentNode:
+		fmt.Fprint(w, "parent(name: ")
+		fmt.Fprint(w, n.name)
+		fmt.Fprintln(w, ") [")
+		for i := range n.slots {
+			debugWithLevel(w, n.slots[i], level+2)
+		}
+		fmt.Fprint(w, prefix)
+		fmt.Fprintln(w, "]")
+	case *SlotNode:
+		fmt.Fprint(w, "slot(name: ")
+		fmt.Fprint(w, n.name)
+		fmt.Fprintln(w, ") [")
+		for i := range n.nodes {
+			debugWithLevel(w, n.nodes[i], level+2)
+		}
+		fmt.Fprint(w, prefix)
+		fmt.Fprintln(w, "]")
 	case *BlockNode:
 		key, filters := getKeyFields(n.key)
 		fmt.Fprint(w, "block(key: ")
 		fmt.Fprint(w, key)
 		printFilters(w, filters)
+		if len(n.locals) > 0 {
+			fmt.Fprint(w, ", as: ")
+			fmt.Fprint(w, strings.Join(n.locals, ", "))
+		}
 		fmt.Fprint(w, ") [")
 		fmt.Fprintln(w)
 		for i := range n.nodes {
 			debugWithLevel(w, n.nodes[i], level+2)
 		}
+		if len(n.alt) > 0 {
+			fmt.Fprint(w, prefix)
+			fmt.Fprintln(w, "] else [")
+			for i := range n.alt {
+				debugWithLevel(w, n.alt[i], level+2)
+			}
+		}
 		fmt.Fprint(w, prefix)
 		fmt.Fprintln(w, "]")
+	case *CaptureNode:
+		fmt.Fprint(w, "capture(name: ")
+		fmt.Fprint(w, n.ident)
+		printFilters(w, n.filters)
+		fmt.Fprint(w, ") [")
+		fmt.Fprintln(w)
+		for i := range n.nodes {
+			debugWithLevel(w, n.nodes[i], level+2)
+		}
+		fmt.Fprint(w, prefix)
+		fmt.Fprintln(w, "]")
+	case *BreakNode:
+		fmt.Fprint(w, "break(")
+		if key, filters := getKeyFields(n.key); key != "" {
+			fmt.Fprint(w, "key: ")
+			fmt.Fprint(w, key)
+			printFilters(w, filters)
+		}
+		fmt.Fprintln(w, ")")
+	case *ContinueNode:
+		fmt.Fprint(w, "continue(")
+		if key, filters := getKeyFields(n.key); key != "" {
+			fmt.Fprint(w, "key: ")
+			fmt.Fprint(w, key)
+			printFilters(w, filters)
+		}
+		fmt.Fprintln(w, ")")
 	case *VariableNode:
 		key, filters := getKeyFields(n.key)
 		fmt.Fprint(w, "variable(key: ")
@@ -114,6 +182,17 @@ func getKeyFields(k Key) (string, []Filter) {
 		return k.name, k.filters
 	case ValueKey:
 		return k.literal, k.filters
+	case UnaryKey:
+		key, _ := getKeyFields(k.right)
+		return fmt.Sprintf("(%s %s)", token.Token{Type: k.op}, key), nil
+	case BinaryKey:
+		left, _ := getKeyFields(k.left)
+		right, _ := getKeyFields(k.right)
+		return fmt.Sprintf("(%s %s %s)", left, token.Token{Type: k.op}, right), nil
+	case GroupKey:
+		key, filters := getKeyFields(k.key)
+		key = fmt.Sprintf("(%s%s)", key, formatFilters(filters))
+		return key, k.filters
 	default:
 		return "", nil
 	}
@@ -131,3 +210,12 @@ func printFilters(w io.Writer, filters []Filter) {
 		fmt.Fprint(w, f.name)
 	}
 }
+
+func formatFilters(filters []Filter) string {
+	var str strings.Builder
+	for _, f := range filters {
+		str.WriteString(" | ")
+		str.WriteString(f.name)
+	}
+	return str.String()
+}
@@ -0,0 +1,696 @@
+package parser
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Safe is a string that is written as is by variables instead of being escaped
+// as HTML or by the escaper of the template.
+type Safe string
+
+// SafeJS is a string that is written as is by variables appearing in a script
+// where a javascript value is expected.
+type SafeJS string
+
+// SafeURL is a string that is written as a URL by variables appearing in a URL
+// attribute instead of being filtered.
+type SafeURL string
+
+var (
+	safeType    = reflect.TypeOf(Safe(""))
+	safeJSType  = reflect.TypeOf(SafeJS(""))
+	safeURLType = reflect.TypeOf(SafeURL(""))
+)
+
+// escaper is a step of the escaping of a value. Values of type safe are not
+// escaped by the step.
+type escaper struct {
+	escape func(string) string
+	safe   reflect.Type
+}
+
+// htmlState is the state of the HTML parser at a given point of a template.
+type htmlState uint8
+
+const (
+	stateText htmlState = iota
+	stateTagName
+	stateTag
+	stateAttrName
+	stateAfterName
+	stateBeforeValue
+	stateAttr
+	stateComment
+	stateRCDATA
+	stateJS
+	stateCSS
+)
+
+var stateNames = []string{
+	stateText:        "text",
+	stateTagName:     "tag name",
+	stateTag:         "tag",
+	stateAttrName:    "attribute name",
+	stateAfterName:   "after attribute name",
+	stateBeforeValue: "before attribute value",
+	stateAttr:        "attribute value",
+	stateComment:     "comment",
+	stateRCDATA:      "rcdata",
+	stateJS:          "script",
+	stateCSS:         "style",
+}
+
+func (s htmlState) String() string {
+	return stateNames[s]
+}
+
+type attrKind uint8
+
+const (
+	attrNone attrKind = iota
+	attrURL
+	attrJS
+	attrCSS
+)
+
+type delimKind uint8
+
+const (
+	delimNone delimKind = iota
+	delimDouble
+	delimSingle
+)
+
+type jsState uint8
+
+const (
+	jsValue jsState = iota
+	jsDouble
+	jsSingle
+	jsTemplate
+	jsLineComment
+	jsBlockComment
+)
+
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota
+	urlPath
+	urlQuery
+)
+
+// htmlContext is the context of the HTML parser at a given point of a
+// template. It is used to select the escaper of variables.
+type htmlContext struct {
+	state   htmlState
+	element string
+	name    string
+	attr    attrKind
+	delim   delimKind
+	js      jsState
+	url     urlPart
+}
+
+func (c htmlContext) String() string {
+	str := c.state.String()
+	if c.element != "" {
+		str += " of " + c.element
+	}
+	if c.name != "" {
+		str += " (" + c.name + ")"
+	}
+	return str
+}
+
+// advance gives the context at the end of str.
+func (c htmlContext) advance(str string) htmlContext {
+	for str != "" {
+		switch c.state {
+		case stateText:
+			c, str = c.text(str)
+		case stateTagName:
+			c, str = c.tagName(str)
+		case stateTag:
+			c, str = c.tag(str)
+		case stateAttrName:
+			c, str = c.attrName(str)
+		case stateAfterName:
+			c, str = c.afterName(str)
+		case stateBeforeValue:
+			c, str = c.beforeValue(str)
+		case stateAttr:
+			c, str = c.attrValue(str)
+		case stateComment:
+			i := strings.Index(str, "-->")
+			if i < 0 {
+				return c
+			}
+			c, str = htmlContext{}, str[i+3:]
+		case stateRCDATA, stateJS, stateCSS:
+			c, str = c.content(str)
+		}
+	}
+	return c
+}
+
+func (c htmlContext) text(str string) (htmlContext, string) {
+	for {
+		i := strings.IndexByte(str, '<')
+		if i < 0 {
+			return c, ""
+		}
+		str = str[i+1:]
+		switch {
+		case strings.HasPrefix(str, "!--"):
+			c.state = stateComment
+			return c, str[3:]
+		case str == "":
+			c.state = stateTagName
+			return c, str
+		case isLetter(str[0]):
+			c.state = stateTagName
+			return c, str
+		case str[0] == '/' && (len(str) == 1 || isLetter(str[1])):
+			c.state, c.element = stateTagName, "/"
+			return c, str[1:]
+		}
+	}
+}
+
+func (c htmlContext) tagName(str string) (htmlContext, string) {
+	i := strings.IndexFunc(str, func(r rune) bool {
+		return !isLetter(byte(r)) && !isDigit(byte(r)) && r != '-' && r != ':'
+	})
+	if i < 0 {
+		c.element += strings.ToLower(str)
+		return c, ""
+	}
+	c.element += strings.ToLower(str[:i])
+	c.state = stateTag
+	return c, str[i:]
+}
+
+func (c htmlContext) tag(str string) (htmlContext, string) {
+	str = strings.TrimLeft(str, " \t\r\n\f/")
+	if str == "" {
+		return c, str
+	}
+	if str[0] != '>' {
+		c.state, c.name = stateAttrName, ""
+		return c, str
+	}
+	element := c.element
+	c = htmlContext{}
+	switch element {
+	case "script":
+		c.state = stateJS
+	case "style":
+		c.state = stateCSS
+	case "title", "textarea":
+		c.state = stateRCDATA
+	default:
+		return c, str[1:]
+	}
+	c.element = element
+	return c, str[1:]
+}
+
+func (c htmlContext) attrName(str string) (htmlContext, string) {
+	i := strings.IndexAny(str, " \t\r\n\f=>/")
+	if i < 0 {
+		c.name += strings.ToLower(str)
+		return c, ""
+	}
+	c.name += strings.ToLower(str[:i])
+	c.state, c.attr = stateAfterName, attrType(c.name)
+	return c, str[i:]
+}
+
+func (c htmlContext) afterName(str string) (htmlContext, string) {
+	str = strings.TrimLeft(str, " \t\r\n\f")
+	if str == "" {
+		return c, str
+	}
+	if str[0] == '=' {
+		c.state = stateBeforeValue
+		return c, str[1:]
+	}
+	c.state, c.name, c.attr = stateTag, "", attrNone
+	return c, str
+}
+
+func (c htmlContext) beforeValue(str string) (htmlContext, string) {
+	str = strings.TrimLeft(str, " \t\r\n\f")
+	if str == "" {
+		return c, str
+	}
+	c.state, c.js, c.url = stateAttr, jsValue, urlStart
+	switch str[0] {
+	case '"':
+		c.delim = delimDouble
+		str = str[1:]
+	case '\'':
+		c.delim = delimSingle
+		str = str[1:]
+	case '>':
+		c.state, c.name, c.attr = stateTag, "", attrNone
+	default:
+		c.delim = delimNone
+	}
+	return c, str
+}
+
+func (c htmlContext) attrValue(str string) (htmlContext, string) {
+	var i int
+	switch c.delim {
+	case delimDouble:
+		i = strings.IndexByte(str, '"')
+	case delimSingle:
+		i = strings.IndexByte(str, '\'')
+	default:
+		i = strings.IndexAny(str, " \t\r\n\f>")
+	}
+	value := str
+	if i >= 0 {
+		value = str[:i]
+	}
+	switch c.attr {
+	case attrJS:
+		c.js = advanceJS(c.js, value)
+	case attrURL:
+		c.url = advanceURL(c.url, value)
+	}
+	if i < 0 {
+		return c, ""
+	}
+	if c.delim != delimNone {
+		i++
+	}
+	element := c.element
+	c = htmlContext{state: stateTag, element: element}
+	return c, str[i:]
+}
+
+// content gives the context after the content of the elements that are not
+// parsed as HTML (script, style, title and textarea).
+func (c htmlContext) content(str string) (htmlContext, string) {
+	i := indexFold(str, "</"+c.element)
+	if c.state == stateJS {
+		if i < 0 {
+			c.js = advanceJS(c.js, str)
+		} else {
+			c.js = advanceJS(c.js, str[:i])
+		}
+	}
+	if i < 0 {
+		return c, ""
+	}
+	return htmlContext{}, str[i:]
+}
+
+func advanceJS(js jsState, str string) jsState {
+	for i := 0; i < len(str); i++ {
+		switch js {
+		case jsValue:
+			switch {
+			case str[i] == '"':
+				js = jsDouble
+			case str[i] == '\'':
+				js = jsSingle
+			case str[i] == '`':
+				js = jsTemplate
+			case strings.HasPrefix(str[i:], "//"):
+				js = jsLineComment
+				i++
+			case strings.HasPrefix(str[i:], "/*"):
+				js = jsBlockComment
+				i++
+			}
+		case jsDouble, jsSingle, jsTemplate:
+			switch str[i] {
+			case '\\':
+				i++
+			case jsQuotes[js]:
+				js = jsValue
+			}
+		case jsLineComment:
+			if str[i] == '\n' {
+				js = jsValue
+			}
+		case jsBlockComment:
+			if strings.HasPrefix(str[i:], "*/") {
+				js = jsValue
+				i++
+			}
+		}
+	}
+	return js
+}
+
+var jsQuotes = map[jsState]byte{
+	jsDouble:   '"',
+	jsSingle:   '\'',
+	jsTemplate: '`',
+}
+
+func advanceURL(part urlPart, str string) urlPart {
+	switch {
+	case strings.ContainsAny(str, "?#"):
+		return urlQuery
+	case str != "" && part == urlStart:
+		return urlPath
+	default:
+		return part
+	}
+}
+
+// afterValue gives the context after a variable written in c.
+func (c htmlContext) afterValue() htmlContext {
+	if c.state == stateBeforeValue {
+		c.state, c.delim, c.js = stateAttr, delimNone, jsValue
+	}
+	if c.url == urlStart && (c.state == stateAttr && c.attr == attrURL) {
+		c.url = urlPath
+	}
+	return c
+}
+
+// escaper gives the steps escaping the values written in c.
+func (c htmlContext) escaper() ([]escaper, error) {
+	switch c.state {
+	case stateText, stateRCDATA, stateComment:
+		return []escaper{{html.EscapeString, safeType}}, nil
+	case stateJS:
+		e, err := escapeJS(c.js)
+		return []escaper{e}, err
+	case stateCSS:
+		return []escaper{{escapeCSS, nil}}, nil
+	case stateBeforeValue, stateAttr:
+	default:
+		return nil, fmt.Errorf("value can not be written in %s", c)
+	}
+	var (
+		es  []escaper
+		err error
+	)
+	switch c.attr {
+	case attrJS:
+		var e escaper
+		e, err = escapeJS(c.js)
+		es = append(es, e)
+	case attrCSS:
+		es = append(es, escaper{escapeCSS, nil})
+	case attrURL:
+		switch c.url {
+		case urlStart:
+			es = append(es, escaper{filterURL, safeURLType})
+		case urlPath:
+			es = append(es, escaper{normalizeURL, safeURLType})
+		default:
+			es = append(es, escaper{url.QueryEscape, safeURLType})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.state == stateAttr && c.delim != delimNone {
+		return append(es, escaper{html.EscapeString, safeType}), nil
+	}
+	return append(es, escaper{escapeUnquoted, nil}), nil
+}
+
+// filtered replaces the values that are unsafe in a URL or a CSS value.
+const filtered = "filtered"
+
+func escapeJS(js jsState) (escaper, error) {
+	switch js {
+	case jsValue:
+		return escaper{escapeJSValue, safeJSType}, nil
+	case jsDouble, jsSingle, jsTemplate:
+		return escaper{escapeJSString, nil}, nil
+	default:
+		return escaper{}, fmt.Errorf("value can not be written in a script comment")
+	}
+}
+
+var jsLiteral = regexp.MustCompile(`^(true|false|null|-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?)$`)
+
+// escapeJSValue gives str as a javascript string literal unless str is a
+// number, a boolean or null.
+func escapeJSValue(str string) string {
+	if jsLiteral.MatchString(str) {
+		return str
+	}
+	return "\"" + escapeJSString(str) + "\""
+}
+
+func escapeJSString(str string) string {
+	var buf strings.Builder
+	for _, r := range str {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r < ' ' || r == '\u2028' || r == '\u2029' || strings.ContainsRune("'\"`<>&/=$", r):
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func escapeCSS(str string) string {
+	for i := 0; i < len(str); i++ {
+		if !isLetter(str[i]) && !isDigit(str[i]) && strings.IndexByte(" #%.,-_", str[i]) < 0 {
+			return filtered
+		}
+	}
+	return str
+}
+
+// filterURL replaces str if it has another scheme than http, https or mailto.
+func filterURL(str string) string {
+	if i := strings.IndexAny(str, ":/?#"); i >= 0 && str[i] == ':' {
+		switch strings.ToLower(str[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#" + filtered
+		}
+	}
+	return normalizeURL(str)
+}
+
+// normalizeURL percent-encodes the characters of str that are not allowed in
+// a URL.
+func normalizeURL(str string) string {
+	var buf strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if isLetter(c) || isDigit(c) || strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) >= 0 {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+// escapeUnquoted escapes str for an unquoted attribute value.
+func escapeUnquoted(str string) string {
+	var buf strings.Builder
+	for _, r := range str {
+		if r < utf8.RuneSelf && (isLetter(byte(r)) || isDigit(byte(r)) || strings.ContainsRune("-_.,:/%", r)) {
+			buf.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&buf, "&#x%X;", r)
+	}
+	return buf.String()
+}
+
+func attrType(name string) attrKind {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attrJS
+	case name == "style":
+		return attrCSS
+	}
+	switch name {
+	case "href", "src", "action", "formaction", "cite", "poster", "background",
+		"data", "codebase", "longdesc", "usemap", "manifest", "icon", "srcset":
+		return attrURL
+	default:
+		return attrNone
+	}
+}
+
+func indexFold(str, sub string) int {
+	for i := 0; i+len(sub) <= len(str); i++ {
+		if strings.EqualFold(str[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// escapeHTML selects the escaper of each variable of root according to the
+// HTML context where it appears. The body of blocks, sections, slots and
+// defines should end in the context where they start and partials, parents
+// and exec tags should appear in text.
+func escapeHTML(root *RootNode, file string) error {
+	var (
+		c   htmlContext
+		err error
+	)
+	if c, err = escapeNodes(root.Nodes, c); err != nil {
+		return err
+	}
+	if c.state != stateText {
+		return fmt.Errorf("%s: template ends in %s", file, c)
+	}
+	names := make([]string, 0, len(root.Named))
+	for k := range root.Named {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		d, ok := root.Named[k].(*DefineNode)
+		if !ok {
+			continue
+		}
+		if c, err = escapeNodes(d.nodes, htmlContext{}); err != nil {
+			return err
+		}
+		if c.state != stateText {
+			return fmt.Errorf("%s: define %s ends in %s", file, d.name, c)
+		}
+	}
+	return nil
+}
+
+// escapeOverrides escapes again the sections of r overriding a section of its
+// parent in the context of the section they override. Overrides of the blocks
+// of Mustache parents are only known when executed: they fail if they are not
+// in the context of the block they override.
+func escapeOverrides(r *RootNode) error {
+	names := make([]string, 0, len(r.Sections))
+	for k := range r.Sections {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		s := r.Sections[k]
+		if s.ctx == nil || s.super == nil || s.super.ctx == nil {
+			continue
+		}
+		if _, err := escapeNode(s, *s.ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeNodes(nodes []Node, c htmlContext) (htmlContext, error) {
+	var err error
+	for _, n := range nodes {
+		if c, err = escapeNode(n, c); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func escapeNode(n Node, c htmlContext) (htmlContext, error) {
+	switch n := n.(type) {
+	case *LiteralNode:
+		return c.advance(n.str), nil
+	case *VariableNode:
+		if n.unescap {
+			return c, nil
+		}
+		es, err := c.escaper()
+		if err != nil {
+			return c, n.contextError(err)
+		}
+		n.escape = es
+		return c.afterValue(), nil
+	case *BlockNode:
+		if err := escapeBody(n.nodes, c, &n.origin); err != nil {
+			return c, err
+		}
+		return c, escapeBody(n.alt, c, &n.origin)
+	case *CaptureNode:
+		return c, escapeBody(n.nodes, htmlContext{}, &n.origin)
+	case *SectionNode:
+		ctx := c
+		if n.super != nil && n.super.ctx != nil {
+			// the section is written where the section it overrides appears
+			ctx = *n.super.ctx
+		}
+		n.ctx = &ctx
+		return c, escapeBody(n.nodes, ctx, &n.origin)
+	case *SlotNode:
+		n.ctx = &c
+		return c, escapeBody(n.nodes, c, &n.origin)
+	case *ParentNode:
+		if c.state != stateText {
+			return c, n.contextError(fmt.Errorf("parent can not be included in %s", c))
+		}
+		for _, s := range n.slots {
+			if _, err := escapeNode(s, c); err != nil {
+				return c, err
+			}
+		}
+		return c, nil
+	case *PartialNode:
+		if c.state != stateText {
+			return c, n.contextError(fmt.Errorf("partial can not be included in %s", c))
+		}
+	case *ExecNode:
+		if c.state != stateText {
+			return c, n.contextError(fmt.Errorf("exec can not be called in %s", c))
+		}
+	case *SuperNode:
+		if s := n.section.super; s != nil && s.ctx != nil && *s.ctx == c {
+			return c, nil
+		}
+		if c.state != stateText {
+			return c, n.contextError(fmt.Errorf("super can not be called in %s", c))
+		}
+	}
+	return c, nil
+}
+
+func escapeBody(nodes []Node, c htmlContext, o *origin) error {
+	end, err := escapeNodes(nodes, c)
+	if err != nil {
+		return err
+	}
+	if end != c {
+		return o.contextError(fmt.Errorf("body starts in %s but ends in %s", c, end))
+	}
+	return nil
+}
+
+func (o *origin) contextError(err error) error {
+	return fmt.Errorf("%s: %s: %w", where(o.file, o.pos), o.tag, err)
+}
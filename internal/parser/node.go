@@ -1,13 +1,18 @@
 package parser
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
 	"html"
 	"io"
+	"os"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/midbel/curly/internal/filters"
 	"github.com/midbel/curly/internal/state"
 	"github.com/midbel/curly/internal/token"
 )
@@ -17,6 +22,101 @@ var (
 	ErrContinue = errors.New("continue")
 )
 
+type Frame struct {
+	Kind string
+	Name string
+	File string
+	token.Position
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s %s (%s)", f.Kind, f.Name, where(f.File, f.Position))
+}
+
+type ExecError struct {
+	File string
+	token.Position
+	Tag   string
+	Stack []Frame
+	Err   error
+}
+
+func (e *ExecError) Error() string {
+	var str strings.Builder
+	str.WriteString(where(e.File, e.Position))
+	str.WriteString(": ")
+	if e.Tag != "" {
+		str.WriteString(e.Tag)
+		str.WriteString(": ")
+	}
+	str.WriteString(e.Err.Error())
+	for i := range e.Stack {
+		str.WriteString("\n\tcalled from ")
+		str.WriteString(e.Stack[i].String())
+	}
+	return str.String()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+func where(file string, pos token.Position) string {
+	if file == "" {
+		return pos.String()
+	}
+	return fmt.Sprintf("%s:%s", file, pos)
+}
+
+type origin struct {
+	file string
+	pos  token.Position
+	tag  string
+}
+
+func (o *origin) setOrigin(other origin) {
+	*o = other
+}
+
+func (o *origin) wrap(err error) error {
+	if errors.Is(err, ErrBreak) || errors.Is(err, ErrContinue) {
+		return err
+	}
+	var e *ExecError
+	if errors.As(err, &e) {
+		return err
+	}
+	return &ExecError{
+		File:     o.file,
+		Position: o.pos,
+		Tag:      o.tag,
+		Err:      err,
+	}
+}
+
+// jump gives the error err of a break or continue tag with its position.
+func (o *origin) jump(err error) error {
+	return &ExecError{
+		File:     o.file,
+		Position: o.pos,
+		Tag:      o.tag,
+		Err:      err,
+	}
+}
+
+func (o *origin) trace(err error, kind, name string) error {
+	var e *ExecError
+	if errors.As(err, &e) {
+		e.Stack = append(e.Stack, Frame{
+			Kind:     kind,
+			Name:     name,
+			File:     o.file,
+			Position: o.pos,
+		})
+	}
+	return err
+}
+
 type Key interface {
 	Ident() string
 	resolve(state.State) (reflect.Value, error)
@@ -38,6 +138,9 @@ func (n NodeList) Execute(w io.StringWriter, ns Nodeset, s state.State) error {
 			return fmt.Errorf("nil node")
 		}
 		if err := n[i].Execute(w, ns, s); err != nil {
+			if o, ok := n[i].(interface{ wrap(error) error }); ok {
+				err = o.wrap(err)
+			}
 			return err
 		}
 	}
@@ -54,6 +157,15 @@ func (ns Nodeset) Resolve(name string) Node {
 	return n
 }
 
+// Partial gives the node registered with RegisterPartial under name.
+func (ns Nodeset) Partial(name string) Node {
+	return ns.Resolve(">" + name)
+}
+
+func (ns Nodeset) RegisterPartial(name string, node Node) {
+	ns[">"+name] = node
+}
+
 func (ns Nodeset) Merge(other Nodeset) Nodeset {
 	for k, v := range other {
 		if _, ok := ns[k]; ok {
@@ -65,12 +177,50 @@ func (ns Nodeset) Merge(other Nodeset) Nodeset {
 }
 
 type RootNode struct {
-	Nodes NodeList
-	Named Nodeset
+	Nodes    NodeList
+	Named    Nodeset
+	Sections map[string]*SectionNode
+	Extends  string
+}
+
+// Inherit gives a new RootNode that executes the nodes of parent where the
+// sections of parent are overridden by the sections of r. The content of an
+// overridden section remains available via the super tag.
+//
+// In templates with the HTML mode, the sections of r are escaped in the context
+// of the sections of parent they override.
+func (r *RootNode) Inherit(parent *RootNode) (*RootNode, error) {
+	root := RootNode{
+		Nodes:    parent.Nodes,
+		Named:    make(Nodeset),
+		Sections: make(map[string]*SectionNode),
+	}
+	for k, s := range parent.Sections {
+		root.Sections[k] = s
+	}
+	for k, s := range r.Sections {
+		s.super = root.Sections[k]
+		root.Sections[k] = s
+	}
+	if err := escapeOverrides(r); err != nil {
+		return nil, err
+	}
+	root.Named.Merge(r.Named)
+	for k, s := range r.Sections {
+		root.Register(k, s)
+	}
+	root.Named.Merge(parent.Named)
+	return &root, nil
 }
 
 func (r *RootNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
-	return r.Nodes.Execute(w, ns, data)
+	err := r.Nodes.Execute(w, ns, data)
+	var e *ExecError
+	if errors.As(err, &e) && (errors.Is(e.Err, ErrBreak) || errors.Is(e.Err, ErrContinue)) {
+		// the section around the tag did not iterate
+		e.Err = fmt.Errorf("%s outside of a loop", e.Err)
+	}
+	return err
 }
 
 func (c *RootNode) Register(name string, node Node) {
@@ -81,6 +231,7 @@ func (c *RootNode) Register(name string, node Node) {
 }
 
 type CommentNode struct {
+	origin
 	str string
 }
 
@@ -98,23 +249,125 @@ func (d *DefineNode) Execute(w io.StringWriter, ns Nodeset, s state.State) error
 }
 
 type PartialNode struct {
-	file string
+	origin
+	file   string
+	mode   Mode
+	indent string
 }
 
 func (p *PartialNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
-	n, err := ParseFile(p.file)
+	n, set, err := loadPartial(ns, p.file, p.mode)
+	if err != nil {
+		return err
+	}
+	return p.trace(n.Execute(indentWriter(w, p.indent), set, data), "partial", p.file)
+}
+
+// ParentNode includes the partial name where the blocks of the partial are
+// overridden by its slots. When blocks are already overridden by an enclosing
+// parent, the outermost override wins.
+type ParentNode struct {
+	origin
+	name   string
+	mode   Mode
+	indent string
+	slots  []*SlotNode
+}
+
+func (p *ParentNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
+	n, set, err := loadPartial(ns, p.name, p.mode)
 	if err != nil {
 		return err
 	}
+	for _, s := range p.slots {
+		if _, ok := set[slotName(s.name)]; ok {
+			continue
+		}
+		set[slotName(s.name)] = s
+	}
+	return p.trace(n.Execute(indentWriter(w, p.indent), set, data), "parent", p.name)
+}
+
+// SlotNode is a block with a default content that can be overridden by the
+// slots of a ParentNode. The indentation of an override is replaced by the
+// indentation of the block it overrides.
+type SlotNode struct {
+	origin
+	name  string
+	nodes NodeList
+	// indentation of the content of the block and whether its open tag is
+	// standalone
+	indent     string
+	standalone bool
+	// context of the block in templates with the HTML mode
+	ctx *htmlContext
+}
+
+func (s *SlotNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
+	n := ns.Resolve(slotName(s.name))
+	if n == nil {
+		return s.nodes.Execute(w, ns, data)
+	}
+	set := make(Nodeset)
+	set.Merge(ns)
+	delete(set, slotName(s.name))
+	if o, ok := n.(*SlotNode); ok {
+		if s.ctx != nil && o.ctx != nil && *s.ctx != *o.ctx {
+			return fmt.Errorf("block overridden in %s at %s but appears in %s", *o.ctx, where(o.file, o.pos), *s.ctx)
+		}
+		w = reindentWriter(w, o.indent, s.indent, s.standalone)
+		return o.nodes.Execute(w, set, data)
+	}
+	return n.Execute(w, set, data)
+}
+
+func slotName(name string) string {
+	return "$" + name
+}
+
+// maxDepth is the maximum number of nested partials and parents.
+const maxDepth = 100
+
+// depthKey is the key of the number of nested partials in a Nodeset.
+const depthKey = "#depth"
+
+type depthNode int
+
+func (depthNode) Execute(_ io.StringWriter, _ Nodeset, _ state.State) error {
+	return nil
+}
+
+// loadPartial gives the partial registered in ns under name or else the
+// template parsed from the file name, and the set of nodes to execute it with.
+func loadPartial(ns Nodeset, name string, mode Mode) (Node, Nodeset, error) {
+	depth, _ := ns.Resolve(depthKey).(depthNode)
+	if depth >= maxDepth {
+		return nil, nil, fmt.Errorf("%s: too many nested partials (max %d)", name, maxDepth)
+	}
+	n := ns.Partial(name)
+	if n == nil {
+		var err error
+		n, err = ParseFileMode(name, mode)
+		if errors.Is(err, os.ErrNotExist) && mode&Mustache != 0 {
+			n, err = NodeList(nil), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	set := make(Nodeset)
 	if root, ok := n.(*RootNode); ok {
-		ns = root.Named.Merge(ns)
+		set.Merge(root.Named)
 	}
-	return n.Execute(w, ns, data)
+	set[depthKey] = depth + 1
+	return n, set.Merge(ns), nil
 }
 
 type ExecNode struct {
-	name string
-	key  Key
+	origin
+	name   string
+	key    Key
+	indent string
 }
 
 func (e *ExecNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
@@ -122,42 +375,151 @@ func (e *ExecNode) Execute(w io.StringWriter, ns Nodeset, data state.State) erro
 	if n == nil {
 		return fmt.Errorf("node %s not found", e.name)
 	}
-	if !e.key.isZero() {
+	if e.key != nil && !e.key.isZero() {
 		val, err := e.key.resolve(data)
 		if err != nil {
 			return err
 		}
 		data = state.EnclosedState(val, data, nil)
 	}
-	return n.Execute(w, ns, data)
+	return e.trace(n.Execute(indentWriter(w, e.indent), ns, data), "exec", e.name)
 }
 
 type SectionNode struct {
+	origin
 	name  string
 	nodes NodeList
+	super *SectionNode
+	// context of the section in templates with the HTML mode
+	ctx *htmlContext
 }
 
 func (s *SectionNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
-	n := ns.Resolve(s.name)
-	if n != nil {
-		return n.Execute(w, ns, data)
+	if n := ns.Resolve(s.name); n != nil && n != Node(s) {
+		return s.trace(n.Execute(w, ns, data), "section", s.name)
 	}
 	return s.nodes.Execute(w, ns, data)
 }
 
+type SuperNode struct {
+	origin
+	section *SectionNode
+}
+
+func (s *SuperNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
+	if s.section.super == nil {
+		return nil
+	}
+	return s.trace(s.section.super.nodes.Execute(w, ns, data), "super", s.section.name)
+}
+
 type LiteralNode struct {
 	str string
 }
 
 func (i *LiteralNode) Execute(w io.StringWriter, _ Nodeset, _ state.State) error {
+	if w, ok := w.(literalWriter); ok {
+		w.writeLiteral(i.str)
+		return nil
+	}
 	w.WriteString(i.str)
 	return nil
 }
 
+type literalWriter interface {
+	writeLiteral(string)
+}
+
+// indenter prefixes each line of the literals of a template with an
+// indentation, after removing the dedent prefix from them. Values are written
+// as is: lines of a multiline value are not indented.
+type indenter struct {
+	io.StringWriter
+	indent  string
+	dedent  string
+	pending bool
+	// the next literal starts a line
+	start bool
+}
+
+func indentWriter(w io.StringWriter, indent string) io.StringWriter {
+	return reindentWriter(w, "", indent, true)
+}
+
+// reindentWriter replaces the indentation dedent of the lines of the literals
+// by indent. pending tells whether the indentation of the first line remains
+// to be written.
+func reindentWriter(w io.StringWriter, dedent, indent string, pending bool) io.StringWriter {
+	if indent == "" && dedent == "" {
+		return w
+	}
+	return &indenter{
+		StringWriter: w,
+		indent:       indent,
+		dedent:       dedent,
+		pending:      pending,
+		start:        true,
+	}
+}
+
+func (i *indenter) WriteString(str string) (int, error) {
+	if str == "" {
+		return 0, nil
+	}
+	i.writeIndent()
+	i.start = false
+	return i.StringWriter.WriteString(str)
+}
+
+func (i *indenter) writeLiteral(str string) {
+	if i.start {
+		str = strings.TrimPrefix(str, i.dedent)
+	}
+	for str != "" {
+		i.writeIndent()
+		n := strings.IndexByte(str, '\n') + 1
+		if n == 0 {
+			n = len(str)
+		}
+		i.write(str[:n])
+		str, i.pending = str[n:], str[n-1] == '\n'
+		if i.start = i.pending; i.start {
+			str = strings.TrimPrefix(str, i.dedent)
+		}
+	}
+}
+
+func (i *indenter) writeIndent() {
+	if i.pending {
+		i.write(i.indent)
+		i.pending = false
+	}
+}
+
+func (i *indenter) write(str string) {
+	if w, ok := i.StringWriter.(literalWriter); ok {
+		w.writeLiteral(str)
+		return
+	}
+	i.StringWriter.WriteString(str)
+}
+
 type BlockNode struct {
+	origin
 	inverted bool
 	key      Key
-	nodes    NodeList
+	locals   []string
+	// locals are given before the key (item in items): a single local is
+	// bound to the element instead of its key
+	named bool
+	nodes NodeList
+	alt   NodeList
+
+	// unparsed content of the block and the delimiters in use, given to
+	// lambdas
+	source string
+	delims [2]string
+	mode   Mode
 }
 
 func (b *BlockNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
@@ -166,45 +528,158 @@ func (b *BlockNode) Execute(w io.StringWriter, ns Nodeset, data state.State) err
 	}
 	val, err := b.key.resolve(data)
 	if err != nil {
-		return nil
+		if err = missingKey(data, err); err != nil {
+			return err
+		}
+		val = state.Invalid
 	}
-	ok := isTrue(val)
+	if val.Kind() == reflect.Func && !val.IsNil() && !b.inverted {
+		return b.lambda(w, ns, val, data)
+	}
+	nodes, alt := b.nodes, b.alt
 	if b.inverted {
-		ok = !ok
+		nodes, alt = alt, nodes
+	}
+	if !isTrue(val) {
+		return alt.Execute(w, ns, data)
 	}
-	if !ok {
+	if len(nodes) == 0 {
 		return nil
 	}
+	if len(b.locals) > 0 {
+		return b.iterate(w, ns, nodes, val, data)
+	}
 	switch k := val.Kind(); k {
 	case reflect.Struct, reflect.Map:
-		err = b.nodes.Execute(w, ns, state.EnclosedState(val, data, nil))
+		err = nodes.Execute(w, ns, state.EnclosedState(val, data, nil))
 	case reflect.Array, reflect.Slice:
-		for i := 0; i < val.Len(); i++ {
-			s := state.Loop(i, val.Len(), state.EnclosedState(val.Index(i), data, nil))
-			err = b.nodes.Execute(w, ns, s)
-			if err != nil {
-				return nil
-			}
+		err = loop(w, ns, nodes, val.Len(), func(i int) state.State {
+			return state.EnclosedState(val.Index(i), data, nil)
+		})
+	default:
+		if b.mode&Mustache == 0 {
+			return nodes.Execute(w, ns, data)
+		}
+		// scalars are the context of the block in Mustache mode
+		err = nodes.Execute(w, ns, state.EnclosedState(val, data, nil))
+	}
+	return err
+}
+
+// lambda calls fn with the unparsed content of the block and renders its
+// result with the delimiters in use at the start of the block.
+func (b *BlockNode) lambda(w io.StringWriter, ns Nodeset, fn reflect.Value, data state.State) error {
+	var (
+		left, right = b.delims[0], b.delims[1]
+		render      = func(str string) (string, error) {
+			return renderText(str, b.mode, left, right, ns, data)
 		}
+		str string
+		err error
+	)
+	switch t := fn.Type(); {
+	case t.ConvertibleTo(sectionLambda):
+		str = fn.Convert(sectionLambda).Interface().(func(string) string)(b.source)
+	case t.ConvertibleTo(renderLambda):
+		str, err = fn.Convert(renderLambda).Interface().(func(string, Renderer) (string, error))(b.source, render)
 	default:
-		err = b.nodes.Execute(w, ns, data)
+		return fmt.Errorf("%s can not be used as lambda", t)
+	}
+	if err != nil {
+		return err
+	}
+	if str, err = render(str); err == nil {
+		w.WriteString(str)
 	}
 	return err
 }
 
-type BreakNode struct{}
+func (b *BlockNode) iterate(w io.StringWriter, ns Nodeset, nodes NodeList, val reflect.Value, data state.State) error {
+	switch val.Kind() {
+	case reflect.Map:
+		keys := sortKeys(val.MapKeys())
+		return loop(w, ns, nodes, len(keys), func(i int) state.State {
+			return b.bind(data, keys[i], val.MapIndex(keys[i]))
+		})
+	case reflect.Array, reflect.Slice:
+		return loop(w, ns, nodes, val.Len(), func(i int) state.State {
+			return b.bind(data, reflect.ValueOf(i), val.Index(i))
+		})
+	default:
+		if !b.named {
+			return fmt.Errorf("%s can not be iterated", val.Kind())
+		}
+		return nodes.Execute(w, ns, b.bind(data, state.Invalid, val))
+	}
+}
+
+func (b *BlockNode) bind(data state.State, key, value reflect.Value) state.State {
+	s := state.Scope(data)
+	if len(b.locals) == 1 {
+		if !b.named {
+			value = key
+		}
+		s.Define(b.locals[0], value)
+		return s
+	}
+	s.Define(b.locals[0], key)
+	s.Define(b.locals[1], value)
+	return s
+}
+
+func loop(w io.StringWriter, ns Nodeset, nodes NodeList, n int, scope func(int) state.State) error {
+	for i := 0; i < n; i++ {
+		err := nodes.Execute(w, ns, state.Loop(i, n, scope(i)))
+		if errors.Is(err, ErrContinue) {
+			continue
+		}
+		if errors.Is(err, ErrBreak) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type BreakNode struct {
+	origin
+	key Key
+}
+
+func (b *BreakNode) Execute(_ io.StringWriter, _ Nodeset, data state.State) error {
+	if ok, err := shouldJump(b.key, data); !ok || err != nil {
+		return err
+	}
+	return b.jump(ErrBreak)
+}
 
-func (_ *BreakNode) Execute(_ io.StringWriter, _ Nodeset, _ state.State) error {
-	return ErrBreak
+type ContinueNode struct {
+	origin
+	key Key
 }
 
-type ContinueNode struct{}
+func (c *ContinueNode) Execute(_ io.StringWriter, _ Nodeset, data state.State) error {
+	if ok, err := shouldJump(c.key, data); !ok || err != nil {
+		return err
+	}
+	return c.jump(ErrContinue)
+}
 
-func (_ *ContinueNode) Execute(_ io.StringWriter, _ Nodeset, _ state.State) error {
-	return ErrContinue
+func shouldJump(key Key, data state.State) (bool, error) {
+	if key == nil {
+		return true, nil
+	}
+	val, err := key.resolve(data)
+	if err != nil {
+		return false, missingKey(data, err)
+	}
+	return isTrue(val), nil
 }
 
 type AssignmentNode struct {
+	origin
 	ident string
 	key   Key
 }
@@ -218,30 +693,143 @@ func (a *AssignmentNode) Execute(_ io.StringWriter, _ Nodeset, data state.State)
 	return nil
 }
 
+// CaptureNode renders its body and defines its output, piped through its
+// filters, as ident. The output is already escaped and is given as Safe to the
+// filters: strings they give are escaped again when written.
+type CaptureNode struct {
+	origin
+	ident   string
+	filters []Filter
+	nodes   NodeList
+}
+
+func (c *CaptureNode) Execute(_ io.StringWriter, ns Nodeset, data state.State) error {
+	var str strings.Builder
+	if err := c.nodes.Execute(&str, ns, data); err != nil {
+		return err
+	}
+	val, err := applyFilters(data, reflect.ValueOf(Safe(str.String())), c.filters)
+	if err != nil {
+		return err
+	}
+	return data.Define(c.ident, val)
+}
+
+// Renderer renders a template text against the current context with the
+// delimiters in use. It is given to lambdas.
+type Renderer func(string) (string, error)
+
+var (
+	variableLambda = reflect.TypeOf((func() string)(nil))
+	sectionLambda  = reflect.TypeOf((func(string) string)(nil))
+	renderLambda   = reflect.TypeOf((func(string, Renderer) (string, error))(nil))
+)
+
+// renderText parses str with the given delimiters (the default ones if empty)
+// and renders it.
+func renderText(str string, mode Mode, left, right string, ns Nodeset, data state.State) (string, error) {
+	n, err := parseText(str, mode, left, right)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := n.Execute(&buf, ns, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 type VariableNode struct {
+	origin
 	key     Key
 	unescap bool
+	mode    Mode
+	// escape is the escaping selected for the HTML context of the variable
+	escape []escaper
 }
 
-func (v *VariableNode) Execute(w io.StringWriter, _ Nodeset, data state.State) error {
+func (v *VariableNode) Execute(w io.StringWriter, ns Nodeset, data state.State) error {
 	val, err := v.key.resolve(data)
 	if err != nil {
+		return missingKey(data, err)
+	}
+	if val.Kind() == reflect.Func && !val.IsNil() && val.Type().ConvertibleTo(variableLambda) {
+		str := val.Convert(variableLambda).Interface().(func() string)()
+		if str, err = renderText(str, v.mode, "", "", ns, data); err != nil {
+			return err
+		}
+		val = reflect.ValueOf(str)
+	}
+	if v.mode&Mustache != 0 && isNil(val) {
 		return nil
 	}
-	str, err := stringify(val, !v.unescap)
-	if err == nil {
-		w.WriteString(str)
+	str, err := stringify(data, val)
+	if err != nil {
+		return err
+	}
+	if !v.unescap {
+		str = v.escapeValue(data, val, str)
+	}
+	w.WriteString(str)
+	return nil
+}
+
+// escapeValue escapes str, the string representation of val, with the escaping
+// selected for the HTML context of v if any, the escaper set in the options of
+// data otherwise. The steps of the escaping that val is safe for are skipped.
+func (v *VariableNode) escapeValue(data state.State, val reflect.Value, str string) string {
+	es := v.escape
+	if es == nil {
+		var fn func(string) string
+		switch e := data.Options().Escaper; {
+		case e != nil:
+			fn = e.Escape
+			if e, ok := e.(state.ValueEscaper); ok {
+				fn = func(str string) string { return e.EscapeValue(val, str) }
+			}
+		case v.mode&Mustache != 0:
+			fn = mustacheEscaper.Replace
+		default:
+			fn = html.EscapeString
+		}
+		es = []escaper{{fn, safeType}}
+	}
+	var typ reflect.Type
+	if val.IsValid() {
+		typ = val.Type()
+	}
+	for _, e := range es {
+		if e.safe == nil || e.safe != typ {
+			str = e.escape(str)
+		}
+	}
+	return str
+}
+
+var mustacheEscaper = strings.NewReplacer("&", "&amp;", "\"", "&quot;", "<", "&lt;", ">", "&gt;")
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	default:
+		return false
 	}
-	return err
 }
 
 type Argument struct {
 	literal string
 	kind    rune
+	key     Key
 }
 
-func (a Argument) get(data state.State) reflect.Value {
-	var val reflect.Value
+func (a Argument) get(data state.State) (reflect.Value, error) {
+	var (
+		val reflect.Value
+		err error
+	)
 	switch a.kind {
 	case token.Integer:
 		if arg, err := strconv.ParseInt(a.literal, 0, 64); err == nil {
@@ -258,10 +846,15 @@ func (a Argument) get(data state.State) reflect.Value {
 			val = reflect.ValueOf(arg)
 		}
 	case token.Ident:
-		val, _ = data.Resolve(a.literal)
+		val, err = resolvePath(data, a.literal)
+		if err != nil && data.Options().Missing != state.MissingError {
+			err = nil
+		}
+	case token.BegGrp:
+		val, err = a.key.resolve(data)
 	default:
 	}
-	return val
+	return val, err
 }
 
 type Filter struct {
@@ -276,16 +869,31 @@ var (
 
 func (f Filter) apply(data state.State, value reflect.Value) (reflect.Value, error) {
 	fn, err := data.Lookup(f.name)
+	method := err != nil
+	if method {
+		// without filter, the method of value with the same name is called
+		if fn = state.Method(value, f.name); !fn.IsValid() {
+			return fn, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	args, err := f.arguments(data)
 	if err != nil {
-		return fn, err
+		return state.Invalid, err
+	}
+	if !method {
+		args = append([]reflect.Value{value}, args...)
 	}
+	return call(fn, args)
+}
+
+func call(fn reflect.Value, args []reflect.Value) (reflect.Value, error) {
 	var (
 		typ  = fn.Type()
 		nin  = typ.NumIn()
 		nout = typ.NumOut()
-		args = append([]reflect.Value{value}, f.arguments(data)...)
+		err  error
 	)
-	if nin == 0 || nout == 0 || nout > 2 || len(args) != nin {
+	if nout == 0 || nout > 2 || len(args) != nin {
 		return state.Invalid, nil
 	}
 	for i := 0; i < nin; i++ {
@@ -294,7 +902,10 @@ func (f Filter) apply(data state.State, value reflect.Value) (reflect.Value, err
 			args[i] = reflect.ValueOf(args[i])
 			continue
 		}
-		if !args[i].IsValid() && canBeNil(args[i].Type()) {
+		if !args[i].IsValid() {
+			if !canBeNil(argtyp) {
+				return state.Invalid, nil
+			}
 			args[i] = reflect.Zero(argtyp)
 		}
 		if args[i].Type().AssignableTo(argtyp) {
@@ -315,12 +926,16 @@ func (f Filter) apply(data state.State, value reflect.Value) (reflect.Value, err
 	return rs[0], err
 }
 
-func (f Filter) arguments(data state.State) []reflect.Value {
+func (f Filter) arguments(data state.State) ([]reflect.Value, error) {
 	as := make([]reflect.Value, len(f.args))
 	for i := range f.args {
-		as[i] = f.args[i].get(data)
+		arg, err := f.args[i].get(data)
+		if err != nil {
+			return nil, err
+		}
+		as[i] = arg
 	}
-	return as
+	return as, nil
 }
 
 type ValueKey struct {
@@ -357,15 +972,7 @@ func (k ValueKey) resolve(data state.State) (reflect.Value, error) {
 	if err != nil {
 		return state.Invalid, err
 	}
-	value := reflect.ValueOf(raw)
-	for i := range k.filters {
-		value, err = k.filters[i].apply(data, value)
-		if err != nil {
-			value = state.Invalid
-			break
-		}
-	}
-	return value, err
+	return applyFilters(data, reflect.ValueOf(raw), k.filters)
 }
 
 type IdentKey struct {
@@ -382,18 +989,238 @@ func (k IdentKey) isZero() bool {
 }
 
 func (k IdentKey) resolve(data state.State) (reflect.Value, error) {
-	value, err := data.Resolve(k.name)
+	value, err := resolvePath(data, k.name)
+	if err != nil {
+		return state.Invalid, err
+	}
+	return applyFilters(data, value, k.filters)
+}
+
+type GroupKey struct {
+	key     Key
+	filters []Filter
+}
+
+func (k GroupKey) Ident() string {
+	return k.key.Ident()
+}
+
+func (k GroupKey) isZero() bool {
+	return k.key.isZero()
+}
+
+func (k GroupKey) resolve(data state.State) (reflect.Value, error) {
+	value, err := k.key.resolve(data)
 	if err != nil {
 		return state.Invalid, err
 	}
-	for i := range k.filters {
-		value, err = k.filters[i].apply(data, value)
+	return applyFilters(data, value, k.filters)
+}
+
+type UnaryKey struct {
+	op    rune
+	right Key
+}
+
+func (k UnaryKey) Ident() string {
+	return k.right.Ident()
+}
+
+func (k UnaryKey) isZero() bool {
+	return k.right.isZero()
+}
+
+func (k UnaryKey) resolve(data state.State) (reflect.Value, error) {
+	switch k.op {
+	case token.Not:
+		right, err := resolveOperand(data, k.right)
 		if err != nil {
-			value = state.Invalid
-			break
+			return state.Invalid, err
+		}
+		return filters.Not(reflect.ValueOf(isTrue(right)))
+	case token.Sub:
+		right, err := k.right.resolve(data)
+		if err != nil {
+			return state.Invalid, err
+		}
+		return filters.Rev(right)
+	default:
+		return state.Invalid, fmt.Errorf("unsupported unary operator")
+	}
+}
+
+type BinaryKey struct {
+	op    rune
+	left  Key
+	right Key
+}
+
+func (k BinaryKey) Ident() string {
+	return k.left.Ident()
+}
+
+func (k BinaryKey) isZero() bool {
+	return k.left.isZero()
+}
+
+func (k BinaryKey) resolve(data state.State) (reflect.Value, error) {
+	if k.op == token.And || k.op == token.Or {
+		return k.resolveLogical(data)
+	}
+	left, err := k.left.resolve(data)
+	if err != nil {
+		return state.Invalid, err
+	}
+	right, err := k.right.resolve(data)
+	if err != nil {
+		return state.Invalid, err
+	}
+	switch k.op {
+	case token.Add:
+		if left.Kind() == reflect.String || right.Kind() == reflect.String {
+			return concat(data, left, right)
 		}
+		return filters.Add(left, right)
+	case token.Sub:
+		return filters.Sub(left, right)
+	case token.Mul:
+		return filters.Mul(left, right)
+	case token.Div:
+		return filters.Div(left, right)
+	case token.Mod:
+		return filters.Mod(left, right)
+	case token.Eq:
+		return filters.Equal(left, right)
+	case token.Ne:
+		return filters.NotEqual(left, right)
+	case token.Lt:
+		return filters.Lesser(left, right)
+	case token.Le:
+		return filters.LesserEqual(left, right)
+	case token.Gt:
+		return filters.Greater(left, right)
+	case token.Ge:
+		return filters.GreaterEqual(left, right)
+	default:
+		return state.Invalid, fmt.Errorf("unsupported binary operator")
+	}
+}
+
+func (k BinaryKey) resolveLogical(data state.State) (reflect.Value, error) {
+	left, err := resolveOperand(data, k.left)
+	if err != nil {
+		return state.Invalid, err
+	}
+	ok := isTrue(left)
+	if (k.op == token.And && !ok) || (k.op == token.Or && ok) {
+		return reflect.ValueOf(ok), nil
+	}
+	right, err := resolveOperand(data, k.right)
+	if err != nil {
+		return state.Invalid, err
+	}
+	if k.op == token.And {
+		return filters.And(reflect.ValueOf(ok), reflect.ValueOf(isTrue(right)))
+	}
+	return filters.Or(reflect.ValueOf(ok), reflect.ValueOf(isTrue(right)))
+}
+
+func resolveOperand(data state.State, key Key) (reflect.Value, error) {
+	val, err := key.resolve(data)
+	if err != nil {
+		if err = missingKey(data, err); err != nil {
+			return state.Invalid, err
+		}
+		val = state.Invalid
+	}
+	return val, nil
+}
+
+func concat(data state.State, left, right reflect.Value) (reflect.Value, error) {
+	str1, err := stringify(data, left)
+	if err != nil {
+		return state.Invalid, err
+	}
+	str2, err := stringify(data, right)
+	if err != nil {
+		return state.Invalid, err
+	}
+	return reflect.ValueOf(str1 + str2), nil
+}
+
+func applyFilters(data state.State, value reflect.Value, filters []Filter) (reflect.Value, error) {
+	var err error
+	for i := range filters {
+		value, err = filters[i].apply(data, value)
+		if err != nil {
+			return state.Invalid, err
+		}
+	}
+	return value, nil
+}
+
+func resolvePath(data state.State, name string) (reflect.Value, error) {
+	if name == "." {
+		return data.Resolve(state.KeyContext)
+	}
+	path := strings.Split(name, ".")
+	value, err := data.Resolve(path[0])
+	if err != nil && len(path) == 1 && errors.Is(err, state.ErrFound) {
+		// an unknown name can be a filter without argument (eg: now)
+		if fn, e := data.Lookup(name); e == nil && fn.Kind() == reflect.Func && fn.Type().NumIn() == 0 {
+			value, err = call(fn, nil)
+		}
+	}
+	if err != nil {
+		if len(path) == 1 {
+			return state.Invalid, fmt.Errorf("%s: %w", name, err)
+		}
+		return state.Invalid, fmt.Errorf("%s: segment %s: %w", name, path[0], err)
+	}
+	for _, seg := range path[1:] {
+		next, err := state.Field(value, seg)
+		if err != nil && data.Options().Missing == state.MissingZero {
+			next = state.Zero(value)
+		}
+		if !next.IsValid() {
+			return state.Invalid, fmt.Errorf("%s: segment %s: %w", name, seg, err)
+		}
+		value = next
+	}
+	return value, nil
+}
+
+// missingKey discards err if it reports a key that can not be resolved unless
+// missing keys are errors.
+func missingKey(data state.State, err error) error {
+	if errors.Is(err, state.ErrFound) && data.Options().Missing != state.MissingError {
+		return nil
+	}
+	return err
+}
+
+func sortKeys(keys []reflect.Value) []reflect.Value {
+	sort.Slice(keys, func(i, j int) bool {
+		return lessValue(keys[i], keys[j])
+	})
+	return keys
+}
+
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	default:
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
 	}
-	return value, err
 }
 
 func isTrue(v reflect.Value) bool {
@@ -411,7 +1238,7 @@ func isTrue(v reflect.Value) bool {
 		return v.Float() != 0
 	case reflect.Map, reflect.Array, reflect.Slice, reflect.String:
 		return v.Len() != 0
-	case reflect.Ptr, reflect.Interface:
+	case reflect.Ptr, reflect.Interface, reflect.Func:
 		return !v.IsNil()
 	case reflect.Struct:
 		return true
@@ -429,7 +1256,32 @@ func canBeNil(typ reflect.Type) bool {
 	}
 }
 
-func stringify(v reflect.Value, escape bool) (string, error) {
+// stringify gives the string representation of v. The formatter registered for
+// the type of v is used first. Otherwise, values of named types are formatted
+// with their MarshalText, String or Error method if they have one, non nil
+// pointers are dereferenced and values of the basic kinds are formatted as is.
+func stringify(data state.State, v reflect.Value) (string, error) {
+	if fn, ok := formatter(data, v); ok {
+		return fn(v)
+	}
+	return toString(data, v)
+}
+
+func formatter(data state.State, v reflect.Value) (state.Formatter, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	fn, ok := data.Options().Formatters[v.Type()]
+	return fn, ok
+}
+
+func toString(data state.State, v reflect.Value) (string, error) {
+	if v.IsValid() && v.Type().PkgPath() != "" {
+		// named types, even of basic kinds, are formatted by their methods
+		if str, ok, err := formatMethod(v); ok {
+			return str, err
+		}
+	}
 	var (
 		str string
 		err error
@@ -447,11 +1299,42 @@ func stringify(v reflect.Value, escape bool) (string, error) {
 		str = strconv.FormatFloat(v.Float(), 'g', -1, 64)
 	case reflect.Invalid:
 		str = "<invalid>"
+	case reflect.Ptr:
+		if v.IsNil() {
+			err = fmt.Errorf("%s can not be stringify", v.Type())
+			break
+		}
+		str, err = stringify(data, v.Elem())
 	default:
-		err = fmt.Errorf("%s can not be stringify", v)
-	}
-	if err == nil && escape {
-		str = html.EscapeString(str)
+		str, err = format(v)
 	}
 	return str, err
 }
+
+func format(v reflect.Value) (string, error) {
+	if str, ok, err := formatMethod(v); ok {
+		return str, err
+	}
+	return "", fmt.Errorf("%s can not be stringify", v.Type())
+}
+
+// formatMethod formats v with its MarshalText, String or Error method. It
+// reports whether v has one of them.
+func formatMethod(v reflect.Value) (string, bool, error) {
+	if !v.CanInterface() {
+		return "", false, nil
+	}
+	switch x := v.Interface().(type) {
+	case encoding.TextMarshaler:
+		buf, err := x.MarshalText()
+		return string(buf), true, err
+	case fmt.Stringer:
+		return x.String(), true, nil
+	case error:
+		return x.Error(), true, nil
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		return formatMethod(v.Addr())
+	}
+	return "", false, nil
+}
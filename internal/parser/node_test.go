@@ -1,8 +1,13 @@
 package parser_test
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/midbel/curly/internal/filters"
 	"github.com/midbel/curly/internal/parser"
@@ -53,6 +58,244 @@ var nodecases = []nodeCase{
 		Want:  "5.1",
 		Ok:    true,
 	},
+	{
+		Name:  "dotted-path",
+		Input: `{{user.address.city}} - {{ctx.user.name | upper}}`,
+		Want:  "brussels - FOOBAR",
+		Ok:    true,
+	},
+	{
+		Name:  "dotted-path-through-map",
+		Input: `{{# user.tags.lang }}{{ user.tags.lang }}{{/ user.tags.lang }}`,
+		Want:  "go",
+		Ok:    true,
+	},
+	{
+		Name:  "block-else",
+		Input: `{{# name | eq "barfoo" }}barfoo{{else}}{{name}}{{/ name }}`,
+		Want:  "foobar",
+		Ok:    true,
+	},
+	{
+		Name:  "block-else-empty-list",
+		Input: `{{# empty }}{{ctx}}{{ else }}no items{{/ empty }}`,
+		Want:  "no items",
+		Ok:    true,
+	},
+	{
+		Name:  "inverted-else",
+		Input: `{{^ list }}no items{{else}}{{ctx}}{{/ list }}`,
+		Want:  "foobarfoo",
+		Ok:    true,
+	},
+	{
+		Name:  "inverted-missing-key",
+		Input: `{{^ missing }}missing{{/ missing }}`,
+		Want:  "missing",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-break",
+		Input: `{{# list }}{{ctx}}{{break loop | eq 2}}-{{/ list }}`,
+		Want:  "foo-bar",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-continue",
+		Input: `{{# list }}{{# ctx | eq "bar" }}{{continue}}{{/ ctx }}{{ctx}}{{/ list }}`,
+		Want:  "foofoo",
+		Ok:    true,
+	},
+	{
+		Name:  "section-scalar-context",
+		Input: `{{# name }}{{: x "a" }}{{/ name }}[{{ x }}]`,
+		Want:  "[a]",
+		Ok:    true,
+	},
+	{
+		Name:  "break-in-section",
+		Input: `{{# name }}a{{break}}b{{/ name }}c`,
+	},
+	{
+		Name:  "group-argument",
+		Input: `{{ 1 | add (list | len) }}-{{ 2 | add (1 | add (empty | len)) }}`,
+		Want:  "4-3",
+		Ok:    true,
+	},
+	{
+		Name:  "group-key",
+		Input: `{{# (list | len | eq 3) }}{{ (name | upper) | lower }}{{/ list }}`,
+		Want:  "foobar",
+		Ok:    true,
+	},
+	{
+		Name:  "expr-math",
+		Input: `{{ 1 + 2 * 3 }} {{ (1 + 2) * 3 }} {{ 7 % 4 - -1 }} {{ (list | len) / 2.0 }}`,
+		Want:  "7 9 4 1.5",
+		Ok:    true,
+	},
+	{
+		Name:  "expr-concat",
+		Input: `{{ name + "-" + user.address.city | upper }}`,
+		Want:  "FOOBAR-BRUSSELS",
+		Ok:    true,
+	},
+	{
+		Name:  "expr-logical",
+		Input: `{{# name == "foobar" && (missing || (list | len) > 2) }}ok{{/ name }}{{# !(1 < 2) }}ko{{else}}ok{{/ 1 }}`,
+		Want:  "okok",
+		Ok:    true,
+	},
+	{
+		Name:  "expr-assignment",
+		Input: `{{: var (list | len) * 10 }}{{ var != 30 }}`,
+		Want:  "false",
+		Ok:    true,
+	},
+	{
+		Name:  "map-iteration",
+		Input: `{{# ports as name, port }}{{loop}}/{{length}}:{{name}}={{port}}({{ctx.name}});{{/ ports }}`,
+		Want:  "1/3:http=80(foobar);2/3:https=443(foobar);3/3:ssh=22(foobar);",
+		Ok:    true,
+	},
+	{
+		Name:  "slice-iteration",
+		Input: `{{# list as i, str }}{{i}}{{str}}{{/ list }}-{{# list as i }}{{i}}{{/ list }}`,
+		Want:  "0foo1bar2foo-012",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-first-last",
+		Input: `{{# list }}{{# first }}[{{/ first }}{{index}}:{{ctx}}{{^ last }},{{else}}]{{/ last }}{{/ list }}`,
+		Want:  "[0:foo,1:bar,2:foo]",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-element-first-last",
+		Input: `{{# people }}{{ first }} {{ last }} {{ index }};{{/ people }}`,
+		Want:  "John Doe 0;Jane Smith 1;",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-even-odd",
+		Input: `{{# list }}{{# odd }}o{{/ odd }}{{# even }}e{{/ even }}{{/ list }}`,
+		Want:  "oeo",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-parent",
+		Input: `{{# list }}{{# list as i }}{{parent.loop}}{{loop}}{{# parent.last && last }}!{{/ parent.last }}{{/ list }}{{/ list }}`,
+		Want:  "111213212223313233!",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-named-item",
+		Input: `{{# item in list }}{{# other in list }}{{ item + other }}{{ name }} {{/ list }}{{/ list }}`,
+		Want:  "foofoofoobar foobarfoobar foofoofoobar barfoofoobar barbarfoobar barfoofoobar foofoofoobar foobarfoobar foofoofoobar ",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-named-key-value",
+		Input: `{{# name, port in ports }}{{ name }}:{{ port }}{{^ last}},{{/ last }}{{/ ports }}`,
+		Want:  "http:80,https:443,ssh:22",
+		Ok:    true,
+	},
+	{
+		Name:  "loop-named-single",
+		Input: `{{# str in list }}{{ str }}{{/ list }}`,
+		Want:  "foobarfoo",
+		Ok:    true,
+	},
+	{
+		Name:  "named-value",
+		Input: `{{# addr in user.address }}{{ addr.city }}/{{ name }}{{/ user.address }}`,
+		Want:  "brussels/foobar",
+		Ok:    true,
+	},
+	{
+		Name:  "dotted-path-missing-segment",
+		Input: `{{user.address.zip}}`,
+		Want:  "",
+		Ok:    true,
+	},
+	{
+		Name:  "triple-mustache",
+		Input: `{{{ "<a&b>" }}}|{{ "<a&b>" }}|{{=<% %>=}}<%{ name | upper }%>`,
+		Want:  "<a&b>|&lt;a&amp;b&gt;|FOOBAR",
+		Ok:    true,
+	},
+	{
+		Name:  "standalone-lines",
+		Input: "list:\n  {{# list }}\n  - {{ ctx }}\n  {{/ list }}\n{{! done }}\nend",
+		Want:  "list:\n  - foo\n  - bar\n  - foo\nend",
+		Ok:    true,
+	},
+	{
+		Name:  "standalone-else",
+		Input: "{{# empty }}\n{{ ctx }}\n{{ else }}\nempty\n{{/ empty }}\n",
+		Want:  "empty\n",
+		Ok:    true,
+	},
+	{
+		Name:  "standalone-with-trim",
+		Input: "list:\n{{- # list -}}\n{{ ctx }},\n{{- / list }}\n",
+		Want:  "list:foo,bar,foo,\n",
+		Ok:    true,
+	},
+	{
+		Name:  "raw",
+		Input: "{{ name }}: {{raw}}{{ name }} {{{ name }}}{{/raw}}",
+		Want:  "foobar: {{ name }} {{{ name }}}",
+		Ok:    true,
+	},
+	{
+		Name:  "raw-nested",
+		Input: "{{raw}}\n{{raw}}{{ name }}{{/raw}}\n{{/raw}}\n",
+		Want:  "{{raw}}{{ name }}{{/raw}}\n",
+		Ok:    true,
+	},
+	{
+		Name:  "raw-with-delimiters",
+		Input: "{{=<% %>=}}<%raw%>{{ name }}<%/raw%> <% name %>",
+		Want:  "{{ name }} foobar",
+		Ok:    true,
+	},
+	{
+		Name:  "raw-trim",
+		Input: "a\n{{- raw -}}\n{{ name }}\n{{- /raw -}}\nb",
+		Want:  "a{{ name }}b",
+		Ok:    true,
+	},
+	{
+		Name:  "capture",
+		Input: "{{: title }}<b>{{ name }}</b>{{/ title }}{{ title }}-{{ title }}",
+		Want:  "<b>foobar</b>-<b>foobar</b>",
+		Ok:    true,
+	},
+	{
+		Name:  "capture-with-filters",
+		Input: "{{: title | upper }}\n{{# list }}{{ . }} {{/ list }}\n{{/ title }}\n{{ title }}|{{ title | lower }}",
+		Want:  "FOO BAR FOO \n|foo bar foo \n",
+		Ok:    true,
+	},
+	{
+		Name:  "standalone-crlf",
+		Input: "{{# list }}\r\n{{ ctx }}\r\n{{/ list }}\r\n",
+		Want:  "foo\nbar\nfoo\n",
+		Ok:    true,
+	},
+	{
+		Name:  "standalone-with-trim",
+		Input: "a\n{{# list }}\n- {{ . }}\n{{/ list }}\nb\n{{- name }}\n",
+		Want:  "a\n- foo\n- bar\n- foo\nbfoobar\n",
+		Ok:    true,
+	},
+	{
+		Name:  "not-standalone",
+		Input: "{{ name }} {{# list }}\n{{ ctx }}{{/ list }}\n",
+		Want:  "foobar \nfoo\nbar\nfoo\n",
+		Ok:    true,
+	},
 }
 
 func TestNode(t *testing.T) {
@@ -62,13 +305,39 @@ func TestNode(t *testing.T) {
 			"upper": strings.ToUpper,
 			"add":   filters.Add,
 			"sub":   filters.Sub,
+			"eq":    filters.Equal,
+			"len":   filters.Len,
+		}
+		addr = struct {
+			City string `curly:"city"`
+		}{
+			City: "brussels",
+		}
+		user = struct {
+			Name    string            `curly:"name"`
+			Address interface{}       `curly:"address"`
+			Tags    map[string]string `curly:"tags"`
+		}{
+			Name:    "foobar",
+			Address: &addr,
+			Tags:    map[string]string{"lang": "go"},
 		}
 		ctx = struct {
-			Name string   `curly:"name"`
-			List []string `curly:"list"`
+			Name   string              `curly:"name"`
+			List   []string            `curly:"list"`
+			Empty  []string            `curly:"empty"`
+			User   interface{}         `curly:"user"`
+			Ports  map[string]int      `curly:"ports"`
+			People []map[string]string `curly:"people"`
 		}{
-			Name: "foobar",
-			List: []string{"foo", "bar", "foo"},
+			People: []map[string]string{
+				{"first": "John", "last": "Doe"},
+				{"first": "Jane", "last": "Smith"},
+			},
+			Ports: map[string]int{"ssh": 22, "https": 443, "http": 80},
+			Name:  "foobar",
+			List:  []string{"foo", "bar", "foo"},
+			User:  user,
 		}
 		state = state.EmptyState(ctx, filters)
 	)
@@ -97,3 +366,729 @@ func TestNode(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeMissingKey(t *testing.T) {
+	data := []struct {
+		Input   string
+		Missing state.MissingKey
+		Want    string
+		Ok      bool
+	}{
+		{
+			Input:   `{{name}}-{{nam}}`,
+			Missing: state.MissingDefault,
+			Want:    "foobar-",
+			Ok:      true,
+		},
+		{
+			Input:   `{{name}}-{{nam}}`,
+			Missing: state.MissingError,
+		},
+		{
+			Input:   `{{# nam }}{{/ nam }}`,
+			Missing: state.MissingError,
+		},
+		{
+			Input:   `{{ name | add count }}`,
+			Missing: state.MissingError,
+		},
+		{
+			Input:   `{{# list }}{{break nam }}{{ . }}{{/ list }}`,
+			Missing: state.MissingError,
+		},
+		{
+			Input:   `{{# list }}{{continue nam }}{{ . }}{{/ list }}`,
+			Missing: state.MissingDefault,
+			Want:    "ab",
+			Ok:      true,
+		},
+		{
+			Input:   `{{name}}-{{ count }}-{{ ctx.sizes.small }}`,
+			Missing: state.MissingZero,
+			Want:    "foobar--0",
+			Ok:      true,
+		},
+	}
+	ctx := map[string]interface{}{
+		"name":  "foobar",
+		"sizes": map[string]int{},
+		"list":  []string{"a", "b"},
+	}
+	for _, d := range data {
+		n, err := parser.ParseString(d.Input)
+		if err != nil {
+			t.Errorf("%s: expecting no error parsing! got %s", d.Input, err)
+			continue
+		}
+		var (
+			str  strings.Builder
+			opts = state.Options{Missing: d.Missing}
+		)
+		err = n.Execute(&str, nil, state.NewState(ctx, nil, opts))
+		switch {
+		case d.Ok && err != nil:
+			t.Errorf("%s: unexpected error %s", d.Input, err)
+		case !d.Ok && err == nil:
+			t.Errorf("%s: expected error but got none", d.Input)
+		case d.Ok && str.String() != d.Want:
+			t.Errorf("%s: results mismatched! want %s, got %s", d.Input, d.Want, str.String())
+		}
+	}
+}
+
+func TestExecError(t *testing.T) {
+	const demo = `{{< item }}
+  {{ ctx.name }}
+{{/ item }}
+{{# list }}{{@ item }}{{/ list }}`
+
+	n, err := parser.ParseNamed("demo", strings.NewReader(demo))
+	if err != nil {
+		t.Fatalf("unexpected error parsing template! got %s", err)
+	}
+	var (
+		root = n.(*parser.RootNode)
+		ctx  = map[string][]string{"list": {"foo"}}
+		data = state.NewState(ctx, nil, state.Options{Missing: state.MissingError})
+		str  strings.Builder
+	)
+	err = n.Execute(&str, root.Named, data)
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	var e *parser.ExecError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected ExecError! got %T", err)
+	}
+	if e.File != "demo" || e.Line != 2 || e.Column != 3 {
+		t.Errorf("position mismatched! want demo:2,3, got %s:%s", e.File, e.Position)
+	}
+	if want := "{{ ctx.name }}"; e.Tag != want {
+		t.Errorf("tag mismatched! want %s, got %s", want, e.Tag)
+	}
+	if len(e.Stack) != 1 || e.Stack[0].Name != "item" || e.Stack[0].Line != 4 {
+		t.Errorf("stack mismatched! got %v", e.Stack)
+	}
+
+	n, err = parser.ParseNamed("standalone", strings.NewReader("{{# nam }}\n{{/ nam }}\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing template! got %s", err)
+	}
+	err = n.Execute(&str, nil, data)
+	if !errors.As(err, &e) {
+		t.Fatalf("expected ExecError! got %v", err)
+	}
+	if want := "{{# nam }}"; e.Tag != want {
+		t.Errorf("tag mismatched! want %q, got %q", want, e.Tag)
+	}
+
+	n, err = parser.ParseNamed("break", strings.NewReader("{{# name }}\n  {{break}}\n{{/ name }}"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing template! got %s", err)
+	}
+	err = n.Execute(&str, nil, state.EmptyState(map[string]string{"name": "foo"}, nil))
+	if !errors.As(err, &e) {
+		t.Fatalf("expected ExecError! got %v", err)
+	}
+	if e.File != "break" || e.Line != 2 || e.Column != 3 {
+		t.Errorf("position mismatched! want break:2,3, got %s:%s", e.File, e.Position)
+	}
+
+	n, err = parser.ParseNamed("filter", strings.NewReader("{{ ctx | upper }}"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing template! got %s", err)
+	}
+	err = n.Execute(&str, nil, state.NewState(map[string]string{"ctx": "foo"}, nil, state.Options{Missing: state.MissingError}))
+	if !errors.As(err, &e) {
+		t.Fatalf("expected ExecError! got %v", err)
+	}
+	if !errors.Is(err, state.ErrFound) || !strings.HasPrefix(e.Err.Error(), "upper: ") {
+		t.Errorf("error does not name the filter! got %s", err)
+	}
+}
+
+func TestNodeMustache(t *testing.T) {
+	partials := map[string]string{
+		"parent":      "{{$foo}}default content{{/foo}}",
+		"stuff":       "|{{$stuff}}...{{/stuff}}{{$default}} default{{/default}}|",
+		"nested":      "{{#nested}}{{$block}}You say {{fruit}}.{{/block}}{{/nested}}",
+		"older":       "{{<grand}}{{$a}}o{{/a}}{{/grand}}",
+		"middle":      "{{<older}}{{$a}}p{{/a}}{{/older}}",
+		"grand":       "{{$a}}g{{/a}}",
+		"recurse":     "{{$foo}}default content{{/foo}} {{$bar}}{{<recurse2}}{{/recurse2}}{{/bar}}",
+		"recurse2":    "{{$foo}}parent2 default content{{/foo}} {{<recurse}}{{$bar}}don't recurse{{/bar}}{{/recurse}}",
+		"placeholder": "{{$foo}}{{$foo}}inner{{/foo}}{{/foo}}",
+	}
+	data := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "default",
+			Input: "{{$title}}Default title{{/title}}",
+			Want:  "Default title",
+		},
+		{
+			Name:  "parent-default",
+			Input: "{{<parent}}{{/parent}}",
+			Want:  "default content",
+		},
+		{
+			Name:  "parent-override",
+			Input: "{{<parent}} ignored {{$foo}}hmm{{/foo}} ignored {{/parent}}",
+			Want:  "hmm",
+		},
+		{
+			Name:  "two-parents",
+			Input: "test {{<stuff}}{{$stuff}}override1{{/stuff}}{{/stuff}} {{<stuff}}{{$stuff}}override2{{/stuff}}{{/stuff}}",
+			Want:  "test |override1 default| |override2 default|",
+		},
+		{
+			Name:  "block-scope",
+			Input: "{{<nested}}{{$block}}I say {{fruit}}.{{/block}}{{/nested}}",
+			Want:  "I say bananas.",
+		},
+		{
+			Name:  "multi-level",
+			Input: "{{<middle}}{{$a}}c{{/a}}{{/middle}}",
+			Want:  "c",
+		},
+		{
+			Name:  "multi-level-default",
+			Input: "{{<middle}}{{/middle}}",
+			Want:  "p",
+		},
+		{
+			Name:  "recursion",
+			Input: "{{<recurse}}{{$foo}}override{{/foo}}{{/recurse}}",
+			Want:  "override override override don't recurse",
+		},
+		{
+			Name:  "data-does-not-override",
+			Input: "{{$fruit}}fruit in template{{/fruit}}",
+			Want:  "fruit in template",
+		},
+		{
+			Name:  "nested-same-block",
+			Input: "{{<placeholder}}{{/placeholder}}",
+			Want:  "inner",
+		},
+	}
+	ns := make(parser.Nodeset)
+	for k, v := range partials {
+		n, err := parser.ParseMode(k, strings.NewReader(v), parser.Mustache)
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing partial: %s", k, err)
+		}
+		ns.RegisterPartial(k, n)
+	}
+	ctx := map[string]interface{}{
+		"fruit": "apples",
+		"nested": map[string]interface{}{
+			"fruit": "bananas",
+		},
+	}
+	for _, d := range data {
+		n, err := parser.ParseMode(d.Name, strings.NewReader(d.Input), parser.Mustache)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing %s: %s", d.Name, d.Input, err)
+			continue
+		}
+		var str strings.Builder
+		if err := n.Execute(&str, ns, state.EmptyState(ctx, nil)); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: results mismatched! want %q, got %q", d.Name, d.Want, got)
+		}
+	}
+}
+
+func TestNodeMustacheRecursion(t *testing.T) {
+	ns := make(parser.Nodeset)
+	for k, v := range map[string]string{
+		"self":  "{{<self}}{{/self}}",
+		"other": "{{>self}}",
+	} {
+		n, err := parser.ParseMode(k, strings.NewReader(v), parser.Mustache)
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing partial: %s", k, err)
+		}
+		ns.RegisterPartial(k, n)
+	}
+	for _, str := range []string{"{{<self}}{{/self}}", "{{>other}}"} {
+		n, err := parser.ParseMode("recursion", strings.NewReader(str), parser.Mustache)
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing: %s", str, err)
+			continue
+		}
+		var w strings.Builder
+		if err := n.Execute(&w, ns, state.EmptyState(nil, nil)); err == nil {
+			t.Errorf("%s: expected error but template executed", str)
+		}
+	}
+}
+
+func TestNodeHTMLOverride(t *testing.T) {
+	parse := func(str string, mode parser.Mode) *parser.RootNode {
+		t.Helper()
+		n, err := parser.ParseMode("html", strings.NewReader(str), mode)
+		if err != nil {
+			t.Fatalf("%s: unexpected error parsing: %s", str, err)
+		}
+		return n.(*parser.RootNode)
+	}
+	ctx := map[string]interface{}{
+		"name": `</script><b>"foo"`,
+	}
+
+	base := parse(`<script>var name = {{% value }}null{{/ value }};</script>`, parser.HTML)
+	page := parse(`{{% value }}{{ name }}{{/ value }}`, parser.HTML)
+	root, err := page.Inherit(base)
+	if err != nil {
+		t.Fatalf("unexpected error inheriting: %s", err)
+	}
+	var str strings.Builder
+	if err := root.Execute(&str, root.Named, state.EmptyState(ctx, nil)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `<script>var name = "\u003c\u002fscript\u003e\u003cb\u003e\u0022foo\u0022";</script>`
+	if got := str.String(); got != want {
+		t.Errorf("results mismatched!\nwant %s\ngot  %s", want, got)
+	}
+
+	base = parse(`<script>var name = "{{% value }}{{/ value }}";</script>`, parser.HTML)
+	page = parse(`{{% value }}"{{/ value }}`, parser.HTML)
+	if _, err := page.Inherit(base); err == nil {
+		t.Errorf("expected error but section overridden")
+	}
+
+	ns := make(parser.Nodeset)
+	ns.RegisterPartial("parent", parse(`<script>var name = {{$value}}null{{/value}};</script>`, parser.HTML|parser.Mustache))
+	child := parse(`{{<parent}}{{$value}}{{name}}{{/value}}{{/parent}}`, parser.HTML|parser.Mustache)
+	str.Reset()
+	if err := child.Execute(&str, ns, state.EmptyState(ctx, nil)); err == nil {
+		t.Errorf("expected error but block overridden: %s", str.String())
+	}
+}
+
+func TestNodeIndent(t *testing.T) {
+	const demo = `{{< entry }}
+- {{ name }}
+- {{ text }}
+{{/ entry }}
+entries:
+  {{@ entry }}
+nested:
+  {{> outer }}
+trimmed:
+{{- name }}
+`
+	partials := map[string]string{
+		"outer": "outer:\n  {{> inner }}\n",
+		"inner": "inner: {{ name }}\n",
+	}
+	data := []struct {
+		Mode parser.Mode
+		Want string
+	}{
+		{
+			Want: "entries:\n  - foobar\n  - foo\nbar\nnested:\n  outer:\n    inner: foobar\ntrimmed:foobar\n",
+		},
+		{
+			Mode: parser.NoIndent,
+			Want: "entries:\n- foobar\n- foo\nbar\nnested:\nouter:\ninner: foobar\ntrimmed:foobar\n",
+		},
+	}
+	ctx := map[string]string{
+		"name": "foobar",
+		"text": "foo\nbar",
+	}
+	for _, d := range data {
+		n, err := parser.ParseMode("demo", strings.NewReader(demo), d.Mode)
+		if err != nil {
+			t.Fatalf("unexpected error parsing template! got %s", err)
+		}
+		ns := n.(*parser.RootNode).Named
+		for k, v := range partials {
+			p, err := parser.ParseMode(k, strings.NewReader(v), d.Mode)
+			if err != nil {
+				t.Fatalf("%s: unexpected error parsing partial: %s", k, err)
+			}
+			ns.RegisterPartial(k, p)
+		}
+		var str strings.Builder
+		if err := n.Execute(&str, ns, state.EmptyState(ctx, nil)); err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("results mismatched! want %q, got %q", d.Want, got)
+		}
+	}
+}
+
+type person struct {
+	First string
+	Last  string
+	Age   int
+}
+
+func (p person) FullName() string {
+	return p.First + " " + p.Last
+}
+
+func (p *person) Initials() string {
+	return p.First[:1] + p.Last[:1]
+}
+
+func (p person) Greet(greeting string) string {
+	return greeting + " " + p.First
+}
+
+func (p person) Retire() (int, error) {
+	if p.Age < 65 {
+		return 0, errors.New("too young")
+	}
+	return p.Age - 65, nil
+}
+
+type team struct {
+	Name string
+	boss person
+}
+
+func TestNodeMethod(t *testing.T) {
+	data := []struct {
+		Input string
+		Want  string
+		Ok    bool
+	}{
+		{
+			Input: `{{ user.FullName }}`,
+			Want:  "john doe",
+			Ok:    true,
+		},
+		{
+			Input: `{{ user.Initials }}`,
+			Want:  "jd",
+			Ok:    true,
+		},
+		{
+			Input: `{{# user }}{{ FullName | upper }}{{/ user }}`,
+			Want:  "JOHN DOE",
+			Ok:    true,
+		},
+		{
+			Input: `{{# users }}{{ Initials }},{{/ users }}`,
+			Want:  "jd,js,",
+			Ok:    true,
+		},
+		{
+			Input: `{{ user | Greet "hello" }}`,
+			Want:  "hello john",
+			Ok:    true,
+		},
+		{
+			Input: `{{ other.Retire }}`,
+			Want:  "5",
+			Ok:    true,
+		},
+		{
+			Input: `{{ user.Retire }}`,
+		},
+		{
+			Input: `{{ team.boss.FullName }}`,
+			Ok:    true,
+		},
+	}
+	ctx := map[string]interface{}{
+		"team":  team{Name: "dev", boss: person{First: "john", Last: "doe"}},
+		"user":  person{First: "john", Last: "doe", Age: 42},
+		"other": &person{First: "jane", Last: "smith", Age: 70},
+		"users": []person{
+			{First: "john", Last: "doe"},
+			{First: "jane", Last: "smith"},
+		},
+	}
+	fns := state.FuncMap{
+		"upper": strings.ToUpper,
+	}
+	for _, d := range data {
+		n, err := parser.ParseString(d.Input)
+		if err != nil {
+			t.Errorf("%s: expecting no error parsing! got %s", d.Input, err)
+			continue
+		}
+		var str strings.Builder
+		err = n.Execute(&str, nil, state.EmptyState(ctx, fns))
+		switch {
+		case d.Ok && err != nil:
+			t.Errorf("%s: unexpected error %s", d.Input, err)
+		case !d.Ok && err == nil:
+			t.Errorf("%s: expected error but got none", d.Input)
+		case d.Ok && str.String() != d.Want:
+			t.Errorf("%s: results mismatched! want %s, got %s", d.Input, d.Want, str.String())
+		}
+	}
+}
+
+type level struct {
+	Value int
+}
+
+func (v level) String() string {
+	return fmt.Sprintf("level-%d", v.Value)
+}
+
+type point struct {
+	X, Y int
+}
+
+type color int
+
+func (c color) String() string {
+	return [...]string{"red", "green", "blue"}[c]
+}
+
+type weight int
+
+func TestNodeStringify(t *testing.T) {
+	data := []struct {
+		Input string
+		Want  string
+		Ok    bool
+	}{
+		{
+			Input: `{{ addr }}`,
+			Want:  "127.0.0.1",
+			Ok:    true,
+		},
+		{
+			Input: `{{ level }}`,
+			Want:  "level-3",
+			Ok:    true,
+		},
+		{
+			Input: `{{ err }}`,
+			Want:  "something &lt;bad&gt; happened",
+			Ok:    true,
+		},
+		{
+			Input: `{{ now }}`,
+			Want:  "2021-09-18T12:30:00Z",
+			Ok:    true,
+		},
+		{
+			Input: `{{ now | year }}`,
+			Want:  "2021",
+			Ok:    true,
+		},
+		{
+			Input: `{{ point }}`,
+			Want:  "(1, 2)",
+			Ok:    true,
+		},
+		{
+			Input: `{{ ptr }}`,
+			Want:  "level-5",
+			Ok:    true,
+		},
+		{
+			Input: `{{ delay }}`,
+			Want:  "2s",
+			Ok:    true,
+		},
+		{
+			Input: `{{ color }} {{ weight }}`,
+			Want:  "green 3",
+			Ok:    true,
+		},
+		{
+			Input: `{{ list }}`,
+		},
+		{
+			Input: `{{ nil }}`,
+		},
+	}
+	var (
+		ctx = map[string]interface{}{
+			"addr":   net.IPv4(127, 0, 0, 1),
+			"level":  level{Value: 3},
+			"err":    errors.New("something <bad> happened"),
+			"point":  point{X: 1, Y: 2},
+			"list":   []int{1, 2},
+			"ptr":    &level{Value: 5},
+			"delay":  2 * time.Second,
+			"nil":    (*level)(nil),
+			"color":  color(1),
+			"weight": weight(3),
+		}
+		fns = state.FuncMap{
+			"now": func() time.Time {
+				return time.Date(2021, 9, 18, 12, 30, 0, 0, time.UTC)
+			},
+			"year": func(t time.Time) int {
+				return t.Year()
+			},
+		}
+		opts = state.Options{
+			Formatters: map[reflect.Type]state.Formatter{
+				reflect.TypeOf(point{}): func(v reflect.Value) (string, error) {
+					p := v.Interface().(point)
+					return fmt.Sprintf("(%d, %d)", p.X, p.Y), nil
+				},
+			},
+		}
+	)
+	for _, d := range data {
+		n, err := parser.ParseString(d.Input)
+		if err != nil {
+			t.Errorf("%s: expecting no error parsing! got %s", d.Input, err)
+			continue
+		}
+		var str strings.Builder
+		err = n.Execute(&str, nil, state.NewState(ctx, fns, opts))
+		switch {
+		case d.Ok && err != nil:
+			t.Errorf("%s: unexpected error %s", d.Input, err)
+		case !d.Ok && err == nil:
+			t.Errorf("%s: expected error but got none", d.Input)
+		case d.Ok && str.String() != d.Want:
+			t.Errorf("%s: results mismatched! want %s, got %s", d.Input, d.Want, str.String())
+		}
+	}
+}
+
+func TestNodeHTML(t *testing.T) {
+	data := []struct {
+		Input string
+		Want  string
+		Ok    bool
+	}{
+		{
+			Input: `<p title="{{ name }}">{{ name }}</p>`,
+			Want:  `<p title="&lt;b&gt;&#34;foo&#34;">&lt;b&gt;&#34;foo&#34;</p>`,
+			Ok:    true,
+		},
+		{
+			Input: `<p class={{ text }}>`,
+			Want:  `<p class=foo&#x20;bar&#x3E;>`,
+			Ok:    true,
+		},
+		{
+			Input: `<a href="{{ link }}">{{ name | len }}</a>`,
+			Want:  `<a href="#filtered">8</a>`,
+			Ok:    true,
+		},
+		{
+			Input: `<a href="{{ site }}/search?q={{ text }}">`,
+			Want:  `<a href="https://example.org/search?q=foo+bar%3E">`,
+			Ok:    true,
+		},
+		{
+			Input: `<script>var name = {{ name }}, n = {{ name | len }}, s = "{{ text }}";</script>`,
+			Want:  `<script>var name = "\u003cb\u003e\u0022foo\u0022", n = 8, s = "foo bar\u003e";</script>`,
+			Ok:    true,
+		},
+		{
+			Input: `<button onclick="run({{ text }})">`,
+			Want:  `<button onclick="run(&#34;foo bar\u003e&#34;)">`,
+			Ok:    true,
+		},
+		{
+			Input: `<p style="color: {{ color }}">{{# list }}<i>{{ . }}</i>{{/ list }}</p>`,
+			Want:  `<p style="color: filtered"><i>a</i><i>b</i></p>`,
+			Ok:    true,
+		},
+		{
+			Input: `<textarea>{{ name }}</textarea>`,
+			Want:  `<textarea>&lt;b&gt;&#34;foo&#34;</textarea>`,
+			Ok:    true,
+		},
+		{
+			Input: `<p>{{& name }}</p>`,
+			Want:  `<p><b>"foo"</p>`,
+			Ok:    true,
+		},
+		{
+			Input: `<p title="{{ safe }}">{{ safe }}</p>`,
+			Want:  `<p title="<em>safe</em>"><em>safe</em></p>`,
+			Ok:    true,
+		},
+		{
+			Input: `<script>var a = {{ safe }}, b = {{ js }};</script>`,
+			Want:  `<script>var a = "\u003cem\u003esafe\u003c\u002fem\u003e", b = {x: "<b>"};</script>`,
+			Ok:    true,
+		},
+		{
+			Input: `<a href="{{ url }}" onclick="{{ js }}">{{ url }}</a>`,
+			Want:  `<a href="javascript:void(0)" onclick="{x: &#34;&lt;b&gt;&#34;}">javascript:void(0)</a>`,
+			Ok:    true,
+		},
+		{
+			Input: `{{: anchor }}<a href="{{ link }}">{{ name }}</a>{{/ anchor }}<p>{{ anchor }}</p>`,
+			Want:  `<p><a href="#filtered">&lt;b&gt;&#34;foo&#34;</a></p>`,
+			Ok:    true,
+		},
+		{
+			Input: `<{{ name }}>`,
+		},
+		{
+			Input: `<p {{ name }}>`,
+		},
+		{
+			Input: `<script>// {{ name }}
+</script>`,
+		},
+		{
+			Input: `{{# list }}<p title="{{/ list }}">`,
+		},
+		{
+			Input: `<a href="{{# list }}{{ . }}{{/ list }}">`,
+		},
+		{
+			Input: `<p title="{{> partial }}">`,
+		},
+		{
+			Input: `<p title="`,
+		},
+	}
+	ctx := map[string]interface{}{
+		"name":  `<b>"foo"`,
+		"text":  "foo bar>",
+		"link":  "javascript:alert(1)",
+		"site":  "https://example.org",
+		"color": "red;}",
+		"list":  []string{"a", "b"},
+		"safe":  parser.Safe("<em>safe</em>"),
+		"js":    parser.SafeJS(`{x: "<b>"}`),
+		"url":   parser.SafeURL("javascript:void(0)"),
+	}
+	fns := state.FuncMap{
+		"len": filters.Len,
+	}
+	for _, d := range data {
+		n, err := parser.ParseMode("html", strings.NewReader(d.Input), parser.HTML)
+		if err != nil {
+			if d.Ok {
+				t.Errorf("%s: unexpected error parsing! got %s", d.Input, err)
+			}
+			continue
+		}
+		if !d.Ok {
+			t.Errorf("%s: expected error but got none", d.Input)
+			continue
+		}
+		var str strings.Builder
+		if err := n.Execute(&str, nil, state.EmptyState(ctx, fns)); err != nil {
+			t.Errorf("%s: unexpected error %s", d.Input, err)
+			continue
+		}
+		if got := str.String(); got != d.Want {
+			t.Errorf("%s: results mismatched!\nwant %s\ngot  %s", d.Input, d.Want, got)
+		}
+	}
+}
@@ -13,12 +13,21 @@ import (
 type Error struct {
 	Line  string
 	Token token.Token
+	// Reason is why the scanner gave an invalid token, if known
+	Reason error
 }
 
 func (e Error) Error() string {
+	if e.Reason != nil {
+		return fmt.Sprintf("%s: %s", e.Token.Position, e.Reason)
+	}
 	return fmt.Sprintf("%s: unexpected token %s", e.Token.Position, e.Token)
 }
 
+func (e Error) Unwrap() error {
+	return e.Reason
+}
+
 func (e Error) Debug() string {
 	var str strings.Builder
 	x, _ := str.WriteString(e.Token.Position.String())
@@ -32,26 +41,69 @@ func (e Error) Debug() string {
 		n++
 	}
 	str.WriteString(strings.Repeat("^", n))
+	if e.Reason != nil {
+		str.WriteString(" ")
+		str.WriteString(e.Reason.Error())
+		return str.String()
+	}
 	str.WriteString(" unexpected token: ")
 	str.WriteString(e.Token.String())
 	return str.String()
 }
 
+// Mode controls the syntax accepted by the parser.
+type Mode uint
+
+const (
+	// Mustache follows the Mustache specification where curly diverges from
+	// it: {{< name}} includes a parent template whose {{$ name}} blocks can be
+	// overridden and defines are not available, nil values are rendered as
+	// nothing, only & < > and " are escaped, partials that can not be found
+	// are rendered as nothing, sections over scalars use the value as context
+	// and line endings are kept as is.
+	Mustache Mode = 1 << iota
+	// NoIndent disables the indentation of the output of partials and exec
+	// tags standing alone on their line.
+	NoIndent
+	// HTML escapes the values of variables according to the HTML context
+	// where they appear (text, attribute, URL, script or style). The body of
+	// blocks, sections and defines should end in the context where it starts
+	// and partials should be included in text.
+	HTML
+)
+
 type Parser struct {
 	scan *scanner.Scanner
 	curr token.Token
 	peek token.Token
 
-	root *RootNode
+	mode   Mode
+	file   string
+	open   token.Token
+	closed *int
+
+	root     *RootNode
+	loops    int
+	depth    int
+	sections []*SectionNode
 
 	parsers map[rune]func() (Node, error)
 }
 
 func Parse(r io.Reader) (Node, error) {
-	p, err := NewParser(r)
+	return ParseNamed("", r)
+}
+
+func ParseNamed(name string, r io.Reader) (Node, error) {
+	return ParseMode(name, r, 0)
+}
+
+func ParseMode(name string, r io.Reader, mode Mode) (Node, error) {
+	p, err := NewParserMode(r, mode)
 	if err != nil {
 		return nil, err
 	}
+	p.file = name
 	return p.Parse()
 }
 
@@ -60,23 +112,49 @@ func ParseString(str string) (Node, error) {
 }
 
 func ParseFile(f string) (Node, error) {
+	return ParseFileMode(f, 0)
+}
+
+func ParseFileMode(f string, mode Mode) (Node, error) {
 	r, err := os.Open(f)
 	if err != nil {
 		return nil, err
 	}
-	return Parse(r)
+	defer r.Close()
+	return ParseMode(f, r, mode)
 }
 
 func NewParser(r io.Reader) (*Parser, error) {
+	return NewParserMode(r, 0)
+}
+
+func NewParserMode(r io.Reader, mode Mode) (*Parser, error) {
 	s, err := scanner.Scan(r)
 	if err != nil {
 		return nil, err
 	}
+	return newParser(s, mode), nil
+}
+
+// parseText parses str with the given delimiters instead of the default ones.
+func parseText(str string, mode Mode, left, right string) (Node, error) {
+	s, err := scanner.Scan(strings.NewReader(str))
+	if err != nil {
+		return nil, err
+	}
+	s.SetDelimiter(left, right)
+	return newParser(s, mode).Parse()
+}
+
+func newParser(s *scanner.Scanner, mode Mode) *Parser {
+	s.SetMustache(mode&Mustache != 0)
 
 	var p Parser
 	p.scan = s
+	p.mode = mode
 	p.root = &RootNode{
-		Named: make(Nodeset),
+		Named:    make(Nodeset),
+		Sections: make(map[string]*SectionNode),
 	}
 	p.parsers = map[rune]func() (Node, error){
 		token.Block:       p.parseBlock,
@@ -90,12 +168,18 @@ func NewParser(r io.Reader) (*Parser, error) {
 		token.Comment:     p.parseComment,
 		token.Partial:     p.parsePartial,
 		token.Delim:       p.parseDelim,
+		token.Break:       p.parseBreak,
+		token.Continue:    p.parseContinue,
+		token.Extends:     p.parseExtends,
+		token.Super:       p.parseSuper,
+		token.Parent:      p.parseParent,
+		token.Slot:        p.parseSlot,
 	}
 
 	p.next()
 	p.next()
 
-	return &p, nil
+	return &p
 }
 
 func (p *Parser) Parse() (Node, error) {
@@ -108,6 +192,7 @@ func (p *Parser) Parse() (Node, error) {
 		case token.Literal:
 			node, err = p.parseLiteral()
 		case token.Open, token.OpenTrim:
+			p.open = p.curr
 			p.next()
 			node, err = p.parseNode()
 			if err != nil {
@@ -123,6 +208,11 @@ func (p *Parser) Parse() (Node, error) {
 			p.root.Nodes = append(p.root.Nodes, node)
 		}
 	}
+	if p.mode&HTML != 0 {
+		if err := escapeHTML(p.root, p.file); err != nil {
+			return nil, err
+		}
+	}
 	return p.root, nil
 }
 
@@ -131,6 +221,9 @@ func (p *Parser) parseAssignment() (Node, error) {
 	if p.curr.Type != token.Ident {
 		return nil, p.unexpectedToken()
 	}
+	if p.peek.Type == token.Close || p.peek.Type == token.CloseTrim || p.peek.Type == token.Pipe {
+		return p.parseCapture()
+	}
 	a := AssignmentNode{
 		ident: p.curr.Literal,
 	}
@@ -144,6 +237,31 @@ func (p *Parser) parseAssignment() (Node, error) {
 	return &a, nil
 }
 
+func (p *Parser) parseCapture() (Node, error) {
+	c := CaptureNode{
+		ident: p.curr.Literal,
+	}
+	fs, err := p.parseFilters()
+	if err != nil {
+		return nil, err
+	}
+	c.filters = fs
+	if err := p.ensureClose(); err != nil {
+		return nil, err
+	}
+	// the body is rendered aside: break and continue do not reach the loops
+	// around it
+	loops := p.loops
+	p.loops = 0
+	ns, err := p.parseBody(c.ident)
+	p.loops = loops
+	if err != nil {
+		return nil, err
+	}
+	c.nodes = ns
+	return &c, nil
+}
+
 func (p *Parser) parseSection() (Node, error) {
 	p.next()
 	if p.curr.Type != token.Ident {
@@ -155,14 +273,41 @@ func (p *Parser) parseSection() (Node, error) {
 	if err := p.ensureClose(); err != nil {
 		return nil, err
 	}
+	p.sections = append(p.sections, &s)
+	defer func() {
+		p.sections = p.sections[:len(p.sections)-1]
+	}()
 	ns, err := p.parseBody(s.name)
 	if err != nil {
 		return nil, err
 	}
 	s.nodes = ns
+	p.root.Sections[s.name] = &s
 	return &s, nil
 }
 
+func (p *Parser) parseExtends() (Node, error) {
+	if p.depth > 0 || p.root.Extends != "" {
+		return nil, p.unexpectedToken()
+	}
+	p.next()
+	if p.curr.Type != token.Literal || p.curr.Literal == "" {
+		return nil, p.unexpectedToken()
+	}
+	p.root.Extends = p.curr.Literal
+	return nil, p.ensureClose()
+}
+
+func (p *Parser) parseSuper() (Node, error) {
+	if len(p.sections) == 0 {
+		return nil, p.unexpectedToken()
+	}
+	s := SuperNode{
+		section: p.sections[len(p.sections)-1],
+	}
+	return &s, p.ensureClose()
+}
+
 func (p *Parser) parseDefine() (Node, error) {
 	p.next()
 	if p.curr.Type != token.Ident {
@@ -174,7 +319,11 @@ func (p *Parser) parseDefine() (Node, error) {
 	if err := p.ensureClose(); err != nil {
 		return nil, err
 	}
+	// the body can be executed anywhere, outside of the loops around it
+	loops := p.loops
+	p.loops = 0
 	ns, err := p.parseBody(d.name)
+	p.loops = loops
 	if err != nil {
 		return nil, err
 	}
@@ -190,9 +339,10 @@ func (p *Parser) parseExec() (Node, error) {
 		return nil, p.unexpectedToken()
 	}
 	e := ExecNode{
-		name: p.curr.Literal,
+		name:   p.curr.Literal,
+		indent: p.indent(),
 	}
-	if p.peek.Type != token.Ident {
+	if p.peek.Type == token.Close || p.peek.Type == token.CloseTrim {
 		return &e, p.ensureClose()
 	}
 	p.next()
@@ -207,11 +357,71 @@ func (p *Parser) parseExec() (Node, error) {
 func (p *Parser) parsePartial() (Node, error) {
 	p.next()
 	n := PartialNode{
-		file: p.curr.Literal,
+		file:   p.curr.Literal,
+		mode:   p.mode,
+		indent: p.indent(),
 	}
 	return &n, p.ensureClose()
 }
 
+func (p *Parser) parseParent() (Node, error) {
+	p.next()
+	if !p.curr.IsValue() || p.curr.Literal == "" {
+		return nil, p.unexpectedToken()
+	}
+	n := ParentNode{
+		name:   p.curr.Literal,
+		mode:   p.mode,
+		indent: p.indent(),
+	}
+	if err := p.ensureClose(); err != nil {
+		return nil, err
+	}
+	ns, err := p.parseBody(n.name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ns {
+		if s, ok := ns[i].(*SlotNode); ok {
+			n.slots = append(n.slots, s)
+		}
+	}
+	return &n, nil
+}
+
+func (p *Parser) parseSlot() (Node, error) {
+	p.next()
+	if p.curr.Type != token.Ident {
+		return nil, p.unexpectedToken()
+	}
+	s := SlotNode{
+		name:   p.curr.Literal,
+		indent: p.lineIndent(p.open.Offset),
+	}
+	pos := p.curr.Offset
+	if err := p.ensureClose(); err != nil {
+		return nil, err
+	}
+	// the newline after a standalone tag is not part of the body
+	s.standalone = strings.Contains(p.scan.Text(pos, p.curr.Offset), "\n")
+	if s.standalone && p.curr.Type == token.Literal {
+		// the indentation of a block on its own lines is the one of its content
+		line := p.curr.Literal
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		if str := strings.TrimLeft(line, " \t"); str != "" && p.mode&NoIndent == 0 {
+			s.indent = line[:len(line)-len(str)]
+		}
+	}
+	ns, err := p.parseBody(s.name)
+	if err != nil {
+		return nil, err
+	}
+	s.nodes = ns
+	return &s, nil
+}
+
 func (p *Parser) parseDelim() (Node, error) {
 	p.next()
 	if p.curr.Type != token.Literal {
@@ -231,22 +441,159 @@ func (p *Parser) parseDelim() (Node, error) {
 func (p *Parser) parseBlock() (Node, error) {
 	b := BlockNode{
 		inverted: p.curr.Type == token.Inverted,
+		mode:     p.mode,
 	}
 	p.next()
-	key, err := p.parseKey()
+	if p.curr.Type == token.Ident && (p.peek.Type == token.In || p.peek.Type == token.Comma) {
+		locals, err := p.parseLocals()
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		if p.curr.Type != token.In {
+			return nil, p.unexpectedToken()
+		}
+		p.next()
+		b.locals = locals
+		b.named = true
+	}
+	key, err := p.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
 	b.key = key
-	ns, err := p.parseBody(b.key.Ident())
+	if p.peek.Type == token.As && len(b.locals) == 0 {
+		p.next()
+		p.next()
+		if b.locals, err = p.parseLocals(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.ensureClose(); err != nil {
+		return nil, err
+	}
+	var (
+		pos         = p.curr.Offset
+		left, right = p.scan.Delimiter()
+	)
+	ns, alt, err := p.parseBodyElse(b.key.Ident(), b.inverted)
 	if err != nil {
 		return nil, err
 	}
 	b.nodes = ns
+	b.alt = alt
+	b.source = p.scan.Text(pos, p.open.Offset)
+	b.delims = [2]string{left, right}
 	return &b, nil
 }
 
+func (p *Parser) parseLocals() ([]string, error) {
+	var locals []string
+	for {
+		if p.curr.Type != token.Ident {
+			return nil, p.unexpectedToken()
+		}
+		locals = append(locals, p.curr.Literal)
+		if p.peek.Type != token.Comma {
+			break
+		}
+		p.next()
+		p.next()
+	}
+	if len(locals) > 2 {
+		return nil, p.unexpectedToken()
+	}
+	return locals, nil
+}
+
+func (p *Parser) parseBreak() (Node, error) {
+	key, err := p.parseLoopKey()
+	if err != nil {
+		return nil, err
+	}
+	return &BreakNode{key: key}, nil
+}
+
+func (p *Parser) parseContinue() (Node, error) {
+	key, err := p.parseLoopKey()
+	if err != nil {
+		return nil, err
+	}
+	return &ContinueNode{key: key}, nil
+}
+
+func (p *Parser) parseLoopKey() (Key, error) {
+	if p.loops == 0 {
+		return nil, p.unexpectedToken()
+	}
+	if p.peek.Type == token.Close || p.peek.Type == token.CloseTrim {
+		return nil, p.ensureClose()
+	}
+	p.next()
+	return p.parseKey()
+}
+
+// indent gives the indentation of the current tag when it stands alone on its
+// line.
+func (p *Parser) indent() string {
+	if p.mode&NoIndent != 0 {
+		return ""
+	}
+	return p.open.Literal
+}
+
+// lineIndent gives the blanks before offset if nothing else precedes it on its
+// line.
+func (p *Parser) lineIndent(offset int) string {
+	if p.mode&NoIndent != 0 {
+		return ""
+	}
+	line := p.scan.Text(0, offset)
+	line = line[strings.LastIndexByte(line, '\n')+1:]
+	if strings.TrimLeft(line, " \t") != "" {
+		return ""
+	}
+	return line
+}
+
+// parseBodyElse parses the body of a block and its else branch. Only the branch
+// executed when the key of the block is true can iterate.
+func (p *Parser) parseBodyElse(name string, inverted bool) ([]Node, []Node, error) {
+	ns, err := p.parseLoopNodes(!inverted)
+	if err != nil {
+		return nil, nil, err
+	}
+	var alt []Node
+	if p.curr.Type == token.Else {
+		if err := p.ensureClose(); err != nil {
+			return nil, nil, err
+		}
+		if alt, err = p.parseLoopNodes(inverted); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ns, alt, p.parseEnd(name)
+}
+
+func (p *Parser) parseLoopNodes(loop bool) ([]Node, error) {
+	if loop {
+		p.loops++
+		defer func() { p.loops-- }()
+	}
+	return p.parseNodes()
+}
+
 func (p *Parser) parseBody(name string) ([]Node, error) {
+	ns, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+	return ns, p.parseEnd(name)
+}
+
+func (p *Parser) parseNodes() ([]Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
 	var ns []Node
 	for !p.done() {
 		if p.curr.Type == token.Literal {
@@ -260,8 +607,9 @@ func (p *Parser) parseBody(name string) ([]Node, error) {
 		if p.curr.Type != token.Open && p.curr.Type != token.OpenTrim {
 			return nil, p.unexpectedToken()
 		}
+		p.open = p.curr
 		p.next()
-		if p.curr.Type == token.End {
+		if p.curr.Type == token.End || p.curr.Type == token.Else {
 			break
 		}
 		node, err := p.parseNode()
@@ -272,14 +620,18 @@ func (p *Parser) parseBody(name string) ([]Node, error) {
 			ns = append(ns, node)
 		}
 	}
+	return ns, nil
+}
+
+func (p *Parser) parseEnd(name string) error {
 	if p.curr.Type != token.End {
-		return nil, p.unexpectedToken()
+		return p.unexpectedToken()
 	}
 	p.next()
-	if p.curr.Type != token.Ident || p.curr.Literal != name {
-		return nil, p.unexpectedToken()
+	if !p.curr.IsValue() || p.curr.Literal != name {
+		return p.unexpectedToken()
 	}
-	return ns, p.ensureClose()
+	return p.ensureClose()
 }
 
 func (p *Parser) parseNode() (Node, error) {
@@ -287,7 +639,23 @@ func (p *Parser) parseNode() (Node, error) {
 	if !ok {
 		return nil, p.unexpectedToken()
 	}
-	return parse()
+	var (
+		open = p.open
+		end  = open.Offset
+	)
+	p.closed = &end
+	node, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := node.(interface{ setOrigin(origin) }); ok {
+		n.setOrigin(origin{
+			file: p.file,
+			pos:  open.Position,
+			tag:  strings.TrimRight(p.scan.Text(open.Offset, end), " \t\n"),
+		})
+	}
+	return node, nil
 }
 
 func (p *Parser) parseLiteral() (Node, error) {
@@ -304,6 +672,7 @@ func (p *Parser) parseComment() (Node, error) {
 func (p *Parser) parseVariable() (Node, error) {
 	n := VariableNode{
 		unescap: p.curr.Unescape(),
+		mode:    p.mode,
 	}
 	p.next()
 	key, err := p.parseKey()
@@ -315,40 +684,144 @@ func (p *Parser) parseVariable() (Node, error) {
 }
 
 func (p *Parser) parseKey() (Key, error) {
-	switch {
-	case p.curr.Type == token.Ident:
-		return p.parseIdentKey()
-	case p.curr.IsValue():
-		return p.parseValueKey()
+	key, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	return key, p.ensureClose()
+}
+
+const (
+	powLowest = iota
+	powOr
+	powAnd
+	powEqual
+	powCompare
+	powAdd
+	powMul
+	powPrefix
+)
+
+var powers = map[rune]int{
+	token.Or:  powOr,
+	token.And: powAnd,
+	token.Eq:  powEqual,
+	token.Ne:  powEqual,
+	token.Lt:  powCompare,
+	token.Le:  powCompare,
+	token.Gt:  powCompare,
+	token.Ge:  powCompare,
+	token.Add: powAdd,
+	token.Sub: powAdd,
+	token.Mul: powMul,
+	token.Div: powMul,
+	token.Mod: powMul,
+}
+
+func (p *Parser) parsePipeline() (Key, error) {
+	key, err := p.parseExpression(powLowest)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := p.parseFilters()
+	if err != nil || len(fs) == 0 {
+		return key, err
+	}
+	switch k := key.(type) {
+	case IdentKey:
+		k.filters = append(k.filters, fs...)
+		return k, nil
+	case ValueKey:
+		k.filters = append(k.filters, fs...)
+		return k, nil
+	case GroupKey:
+		k.filters = append(k.filters, fs...)
+		return k, nil
 	default:
-		return nil, p.unexpectedToken()
+		return GroupKey{key: key, filters: fs}, nil
 	}
 }
 
-func (p *Parser) parseValueKey() (Key, error) {
-	k := ValueKey{
-		literal: p.curr.Literal,
-		kind:    p.curr.Type,
+func (p *Parser) parseExpression(pow int) (Key, error) {
+	left, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
 	}
 	for {
-		if p.peek.Type != token.Pipe {
+		bp, ok := powers[p.peek.Type]
+		if !ok || bp <= pow {
 			break
 		}
 		p.next()
+		if left, err = p.parseInfix(left); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *Parser) parsePrefix() (Key, error) {
+	switch {
+	case p.curr.Type == token.Ident:
+		return IdentKey{name: p.curr.Literal}, nil
+	case p.curr.Type == token.BegGrp:
+		key, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return GroupKey{key: key}, nil
+	case p.curr.Type == token.Not || p.curr.Type == token.Sub:
+		k := UnaryKey{
+			op: p.curr.Type,
+		}
 		p.next()
-		f, err := p.parseFilter()
+		right, err := p.parseExpression(powPrefix)
 		if err != nil {
-			return k, err
+			return nil, err
 		}
-		k.filters = append(k.filters, f)
+		k.right = right
+		return k, nil
+	case p.curr.IsValue():
+		k := ValueKey{
+			literal: p.curr.Literal,
+			kind:    p.curr.Type,
+		}
+		return k, nil
+	default:
+		return nil, p.unexpectedToken()
 	}
-	return k, p.ensureClose()
 }
 
-func (p *Parser) parseIdentKey() (Key, error) {
-	k := IdentKey{
-		name: p.curr.Literal,
+func (p *Parser) parseInfix(left Key) (Key, error) {
+	k := BinaryKey{
+		op:   p.curr.Type,
+		left: left,
+	}
+	pow := powers[p.curr.Type]
+	p.next()
+	right, err := p.parseExpression(pow)
+	if err != nil {
+		return nil, err
+	}
+	k.right = right
+	return k, nil
+}
+
+func (p *Parser) parseGroup() (Key, error) {
+	p.next()
+	key, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
 	}
+	p.next()
+	if p.curr.Type != token.EndGrp {
+		return nil, p.unexpectedToken()
+	}
+	return key, nil
+}
+
+func (p *Parser) parseFilters() ([]Filter, error) {
+	var fs []Filter
 	for {
 		if p.peek.Type != token.Pipe {
 			break
@@ -357,11 +830,11 @@ func (p *Parser) parseIdentKey() (Key, error) {
 		p.next()
 		f, err := p.parseFilter()
 		if err != nil {
-			return k, err
+			return nil, err
 		}
-		k.filters = append(k.filters, f)
+		fs = append(fs, f)
 	}
-	return k, p.ensureClose()
+	return fs, nil
 }
 
 func (p *Parser) parseFilter() (Filter, error) {
@@ -371,7 +844,7 @@ func (p *Parser) parseFilter() (Filter, error) {
 	}
 	f.name = p.curr.Literal
 	for {
-		if !p.peek.IsValue() {
+		if !p.peek.IsValue() && p.peek.Type != token.BegGrp {
 			break
 		}
 		p.next()
@@ -379,6 +852,13 @@ func (p *Parser) parseFilter() (Filter, error) {
 			literal: p.curr.Literal,
 			kind:    p.curr.Type,
 		}
+		if p.curr.Type == token.BegGrp {
+			key, err := p.parseGroup()
+			if err != nil {
+				return f, err
+			}
+			a.key = key
+		}
 		f.args = append(f.args, a)
 	}
 	return f, nil
@@ -389,15 +869,22 @@ func (p *Parser) ensureClose() error {
 	if p.curr.Type != token.Close && p.curr.Type != token.CloseTrim {
 		return p.unexpectedToken()
 	}
+	if p.closed != nil {
+		*p.closed, p.closed = p.peek.Offset, nil
+	}
 	p.next()
 	return nil
 }
 
 func (p *Parser) unexpectedToken() error {
-	return Error{
+	err := Error{
 		Line:  p.scan.GetCurrentLine(),
 		Token: p.curr,
 	}
+	if p.curr.Type == token.Invalid {
+		err.Reason = p.scan.Err()
+	}
+	return err
 }
 
 func (p *Parser) done() bool {
@@ -27,6 +27,36 @@ var testcases = []parseCase{
 		Input: "{{variable}} - {{&variable}}",
 		Ok:    true,
 	},
+	{
+		Name:  "triple-mustache",
+		Input: "{{{ variable }}} - {{=<% %>=}}<%{ variable }%>",
+		Ok:    true,
+	},
+	{
+		Name:  "triple-mustache-unclosed",
+		Input: "{{{ variable }}",
+		Ok:    false,
+	},
+	{
+		Name:  "raw",
+		Input: "{{raw}}{{# block }}{{/raw}}",
+		Ok:    true,
+	},
+	{
+		Name:  "capture",
+		Input: "{{: title | upper }}{{ name }}{{/ title }}",
+		Ok:    true,
+	},
+	{
+		Name:  "capture-unclosed",
+		Input: "{{: title }}{{ name }}",
+		Ok:    false,
+	},
+	{
+		Name:  "raw-unclosed",
+		Input: "{{raw}}{{ variable }}",
+		Ok:    false,
+	},
 	{
 		Name:  "block",
 		Input: "{{# block}}echo {{&variable}}{{/ block}}",
@@ -77,6 +107,56 @@ var testcases = []parseCase{
 		Input: "{{%section}}section{{/section}}",
 		Ok:    true,
 	},
+	{
+		Name:  "dotted-path",
+		Input: "{{# user.address }}{{ city | lower }}{{/ user.address }} {{ ctx.user.name }}",
+		Ok:    true,
+	},
+	{
+		Name:  "block-else",
+		Input: "{{# block}}echo {{variable}}{{else}}empty{{/ block}}",
+		Ok:    true,
+	},
+	{
+		Name:  "inverted-else",
+		Input: "{{^ block}}empty{{ else }}echo {{variable}}{{/ block}}",
+		Ok:    true,
+	},
+	{
+		Name:  "break-continue",
+		Input: "{{# list}}{{continue}}{{# item }}{{ break item | eq 1 }}{{/ item}}{{/ list}}",
+		Ok:    true,
+	},
+	{
+		Name:  "group",
+		Input: "{{# (items | reverse | firstn 3) }}{{ price | mul (qty | add 1) }}{{/ items }}",
+		Ok:    true,
+	},
+	{
+		Name:  "expression",
+		Input: "{{# age >= 18 && (admin || !guest) }}{{ price * qty + 1 }}{{/ age }}{{@ item total - 1 }}",
+		Ok:    true,
+	},
+	{
+		Name:  "block-as",
+		Input: "{{# services | values as name, svc }}{{ name }}: {{ svc.port }}{{/ services }}",
+		Ok:    true,
+	},
+	{
+		Name:  "block-in",
+		Input: "{{# item in items | reverse }}{{ item.name }}{{/ items }}{{# k, v in dict }}{{ k }}{{/ dict }}",
+		Ok:    true,
+	},
+	{
+		Name:  "block-keywords-as-ident",
+		Input: "{{ in }}{{ as | upper }}{{# item in list }}{{ in }}{{/ list }}",
+		Ok:    true,
+	},
+	{
+		Name:  "extends",
+		Input: `{{extends "base.html"}}{{% content }}{{ super }}{{/ content }}`,
+		Ok:    true,
+	},
 	// errors
 	{
 		Name:  "block-error",
@@ -90,6 +170,62 @@ var testcases = []parseCase{
 		Name:  "define-error",
 		Input: "{{#errd}}error{{/error}}",
 	},
+	{
+		Name:  "section-else-error",
+		Input: "{{%section}}section{{else}}error{{/section}}",
+	},
+	{
+		Name:  "break-outside-loop",
+		Input: "{{break}}",
+	},
+	{
+		Name:  "continue-outside-loop",
+		Input: "{{< define}}{{continue}}{{/define}}",
+	},
+	{
+		Name:  "break-in-inverted",
+		Input: "{{^ flag }}a{{break}}b{{/ flag }}c",
+	},
+	{
+		Name:  "continue-in-else",
+		Input: "{{# list }}{{ . }}{{else}}{{continue}}{{/ list }}",
+	},
+	{
+		Name:  "break-in-define",
+		Input: "{{# list }}{{< item }}{{break}}{{/ item }}{{/ list }}",
+	},
+	{
+		Name:  "continue-in-capture",
+		Input: "{{# list }}{{: item }}{{continue}}{{/ item }}{{/ list }}",
+	},
+	{
+		Name:  "group-error",
+		Input: "{{ price | mul (qty | add 1 }}",
+	},
+	{
+		Name:  "expression-error",
+		Input: "{{ price * }}",
+	},
+	{
+		Name:  "block-as-error",
+		Input: "{{# services as name, svc, other }}{{/ services }}",
+	},
+	{
+		Name:  "block-in-error",
+		Input: "{{# item, in items }}{{/ items }}",
+	},
+	{
+		Name:  "extends-in-body-error",
+		Input: `{{% content }}{{extends "base.html"}}{{/ content }}`,
+	},
+	{
+		Name:  "super-outside-section-error",
+		Input: `{{# block }}{{super}}{{/ block }}`,
+	},
+	{
+		Name:  "dotted-path-error",
+		Input: "{{# user.address }}error{{/ user }}",
+	},
 }
 
 func TestParser(t *testing.T) {
@@ -104,3 +240,13 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestParserRawError(t *testing.T) {
+	_, err := parser.ParseString("foo\nbar {{raw}}{{ variable }}")
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	if want := "2,5: unterminated raw block"; err.Error() != want {
+		t.Errorf("errors mismatched! want %q, got %q", want, err)
+	}
+}
@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strings"
 	"unicode/utf8"
@@ -36,8 +37,30 @@ const (
 	rparen     = ')'
 	dollar     = '$'
 	colon      = ':'
+	plus       = '+'
+	star       = '*'
+	comma      = ','
 )
 
+// raw is the name of the tag starting a block whose content is not scanned.
+const raw = "raw"
+
+var errUnterminatedRaw = errors.New("unterminated raw block")
+
+var keywords = map[string]rune{
+	"else":     token.Else,
+	"break":    token.Break,
+	"continue": token.Continue,
+	"extends":  token.Extends,
+	"super":    token.Super,
+}
+
+// blockKeywords are the keywords of the header of a block.
+var blockKeywords = map[string]rune{
+	"as": token.As,
+	"in": token.In,
+}
+
 type Scanner struct {
 	input []byte
 	curr  int
@@ -49,8 +72,13 @@ type Scanner struct {
 	column int
 	seen   int
 
-	scan    func(*token.Token)
-	between bool
+	err        error
+	scan       func(*token.Token)
+	between    bool
+	mustache   bool
+	standalone bool
+	triple     bool
+	header     bool
 
 	// delimiters
 	left      []rune
@@ -65,7 +93,7 @@ func Scan(r io.Reader) (*Scanner, error) {
 		return nil, err
 	}
 	s := Scanner{
-		input:     bytes.ReplaceAll(buf, []byte{cr, nl}, []byte{nl}),
+		input:     buf,
 		line:      1,
 		left:      []rune{lbrace, lbrace},
 		leftdash:  []rune{lbrace, lbrace, dash},
@@ -82,13 +110,32 @@ func (s *Scanner) SkipNL() {
 	}
 }
 
+// Err gives the reason why the last invalid token has been given if it is known.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
 func (s *Scanner) Position() token.Position {
 	return token.Position{
 		Line:   s.line,
 		Column: s.column,
+		Offset: s.curr,
 	}
 }
 
+func (s *Scanner) Text(from, to int) string {
+	if from < 0 || to > len(s.input) || from > to {
+		return ""
+	}
+	return string(s.input[from:to])
+}
+
+// SetMustache enables or disables the Mustache compatible syntax where < is a
+// parent tag and $ a block tag instead of a define tag.
+func (s *Scanner) SetMustache(on bool) {
+	s.mustache = on
+}
+
 func (s *Scanner) SetDelimiter(left, right string) {
 	if left != "" {
 		s.left = []rune(left)
@@ -100,6 +147,10 @@ func (s *Scanner) SetDelimiter(left, right string) {
 	}
 }
 
+func (s *Scanner) Delimiter() (string, string) {
+	return string(s.left), string(s.right)
+}
+
 func (s *Scanner) GetCurrentLine() string {
 	var (
 		pos = s.curr - s.column
@@ -127,10 +178,14 @@ func (s *Scanner) Scan() token.Token {
 		return t
 	}
 	switch {
+	case s.between && s.triple && s.char == rbrace:
+		s.scanTripleClose(&t)
+	case s.between && s.isClose():
+		s.scanClose(&t)
+	case !s.mustache && s.isRaw():
+		s.scanRaw(&t)
 	case s.isOpen():
 		s.scanOpen(&t)
-	case s.isClose():
-		s.scanClose(&t)
 	case isOperator(s.char) && s.between:
 		s.scanOperator(&t)
 		s.scan = nil
@@ -150,6 +205,18 @@ func (s *Scanner) Scan() token.Token {
 
 func (s *Scanner) scanOpen(t *token.Token) {
 	t.Type = token.Open
+	s.standalone = s.isStandalone()
+	if s.standalone {
+		// the literal of a standalone open tag is the indentation of its line
+		var (
+			pos = lineStart(s.input, s.curr)
+			end = pos
+		)
+		for isBlank(rune(s.input[end])) {
+			end++
+		}
+		t.Literal = string(s.input[pos:end])
+	}
 	s.skipOpen()
 	if s.char == dash {
 		s.read()
@@ -166,7 +233,27 @@ func (s *Scanner) scanClose(t *token.Token) {
 		t.Type = token.CloseTrim
 	}
 	s.skipClose()
-	s.scan, s.between = nil, false
+	s.scan, s.between, s.header = nil, false, false
+	if s.standalone {
+		s.skipBlank()
+		if s.char == cr && s.peek() == nl {
+			s.read()
+		}
+		if s.char == nl {
+			s.read()
+		}
+		s.standalone = false
+	}
+}
+
+func (s *Scanner) scanTripleClose(t *token.Token) {
+	s.triple = false
+	s.read()
+	if !s.isClose() {
+		t.Type = token.Invalid
+		return
+	}
+	s.scanClose(t)
 }
 
 func (s *Scanner) scanComment(t *token.Token) {
@@ -188,20 +275,228 @@ func (s *Scanner) scanLiteral(t *token.Token) {
 	for !s.isEOF() && !s.isOpen() {
 		s.read()
 	}
+	end := s.curr
+	if !s.isEOF() && s.isStandalone() {
+		// indentation of a standalone tag is removed with its line
+		for end > pos && isBlank(rune(s.input[end-1])) {
+			end--
+		}
+	}
 	t.Type = token.Literal
-	t.Literal = string(s.input[pos:s.curr])
+	t.Literal = s.literal(pos, end)
+	if tag, _ := s.tagAt(s.curr); !s.mustache {
+		// raw blocks are given as a single literal: the trim marker of their
+		// opening tag is applied here
+		if tag, trim, _ := trimMarkers(tag); trim && tag == raw {
+			t.Literal = strings.TrimSuffix(t.Literal, "\n")
+		}
+	}
+}
+
+// literal gives the text between from and to. Line endings are normalized to
+// \n except in Mustache mode where the text is given as is.
+func (s *Scanner) literal(from, to int) string {
+	str := string(s.input[from:to])
+	if !s.mustache {
+		str = strings.ReplaceAll(str, "\r\n", "\n")
+	}
+	return str
+}
+
+// isStandalone reports whether the tag starting at the current position is
+// alone on its line and does not produce output by itself. Such a tag is
+// removed with the blanks and the newline around it unless it has explicit
+// trim markers.
+//
+// In Mustache mode, a line can also hold several parent, block and end tags,
+// like {{<parent}}{{$block}}, if no block tag is followed by another tag.
+func (s *Scanner) isStandalone() bool {
+	return s.isStandaloneAt(s.curr)
+}
+
+func (s *Scanner) isStandaloneAt(pos int) bool {
+	var (
+		left  = []byte(string(s.left))
+		right = []byte(string(s.right))
+		tags  [][]byte
+		i     = lineStart(s.input, pos)
+	)
+	for {
+		for i < len(s.input) && isBlank(rune(s.input[i])) {
+			i++
+		}
+		if !bytes.HasPrefix(s.input[i:], left) {
+			break
+		}
+		body := s.input[i+len(left):]
+		end := bytes.Index(body, right)
+		if end <= 0 || body[0] == dash || body[end-1] == dash {
+			return false
+		}
+		tags = append(tags, bytes.TrimSpace(body[:end]))
+		i += len(left) + end + len(right)
+	}
+	if i < len(s.input) && skipNL(s.input, i) == i {
+		return false
+	}
+	switch len(tags) {
+	case 0:
+		return false
+	case 1:
+		return isStandaloneTag(tags[0])
+	default:
+		for i, t := range tags {
+			if !s.mustache || len(t) == 0 || !isInheritanceTag(rune(t[0])) {
+				return false
+			}
+			// the content of a block starts on the next line
+			if t[0] == dollar && i < len(tags)-1 {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// lineStart gives the position of the start of the line of pos.
+func lineStart(input []byte, pos int) int {
+	for pos > 0 && input[pos-1] != nl {
+		pos--
+	}
+	return pos
+}
+
+// isRaw reports whether the tag starting at the current position opens a raw
+// block.
+func (s *Scanner) isRaw() bool {
+	tag, _ := s.tagAt(s.curr)
+	tag, _, _ = trimMarkers(tag)
+	return tag == raw
+}
+
+// trimMarkers removes the trim markers of tag. It reports whether tag has a
+// trim marker on its left and on its right.
+func trimMarkers(tag string) (string, bool, bool) {
+	var left, right bool
+	if strings.HasPrefix(tag, "-") {
+		tag, left = strings.TrimSpace(tag[1:]), true
+	}
+	if strings.HasSuffix(tag, "-") {
+		tag, right = strings.TrimSpace(tag[:len(tag)-1]), true
+	}
+	return tag, left, right
+}
+
+// scanRaw scans a raw block up to its matching end tag. The content of the
+// block is given as is as a single literal. Raw blocks can be nested.
+func (s *Scanner) scanRaw(t *token.Token) {
+	var (
+		standalone = s.isStandalone()
+		tag, pos   = s.tagAt(s.curr)
+		start      = pos
+		depth      = 1
+		left       = []byte(string(s.left))
+	)
+	_, _, trim := trimMarkers(tag)
+	if standalone {
+		start = skipLine(s.input, start)
+	} else if trim {
+		start = skipNL(s.input, start)
+	}
+	t.Type = token.Invalid
+	for {
+		i := bytes.Index(s.input[pos:], left)
+		if i < 0 {
+			pos = len(s.input)
+			s.err = errUnterminatedRaw
+			break
+		}
+		pos += i
+		tag, end := s.tagAt(pos)
+		tag, ltrim, rtrim := trimMarkers(tag)
+		switch {
+		case tag == raw:
+			depth++
+		case strings.HasPrefix(tag, "/") && strings.TrimSpace(tag[1:]) == raw:
+			depth--
+		}
+		if depth > 0 {
+			pos += len(left)
+			continue
+		}
+		t.Type = token.Literal
+		t.Literal = s.literal(start, pos)
+		if s.isStandaloneAt(pos) {
+			t.Literal = strings.TrimRight(t.Literal, " \t")
+			end = skipLine(s.input, end)
+		}
+		if ltrim {
+			t.Literal = strings.TrimSuffix(t.Literal, "\n")
+		}
+		if rtrim {
+			end = skipNL(s.input, end)
+		}
+		pos = end
+		break
+	}
+	for s.curr < pos && !s.isEOF() {
+		s.read()
+	}
+}
+
+// tagAt gives the trimmed content of the tag starting at pos and the position
+// after the tag. It gives an empty string if there is no tag at pos.
+func (s *Scanner) tagAt(pos int) (string, int) {
+	var (
+		left  = []byte(string(s.left))
+		right = []byte(string(s.right))
+	)
+	if !bytes.HasPrefix(s.input[pos:], left) {
+		return "", pos
+	}
+	body := s.input[pos+len(left):]
+	end := bytes.Index(body, right)
+	if end < 0 {
+		return "", pos
+	}
+	return string(bytes.TrimSpace(body[:end])), pos + len(left) + end + len(right)
+}
+
+// skipNL gives the position after the newline (\n or \r\n) at pos if any.
+func skipNL(input []byte, pos int) int {
+	if pos+1 < len(input) && input[pos] == cr && input[pos+1] == nl {
+		return pos + 2
+	}
+	if pos < len(input) && input[pos] == nl {
+		pos++
+	}
+	return pos
+}
+
+// skipLine gives the position after the blanks and the newline following pos.
+func skipLine(input []byte, pos int) int {
+	for pos < len(input) && isBlank(rune(input[pos])) {
+		pos++
+	}
+	return skipNL(input, pos)
 }
 
 func (s *Scanner) scanIdent(t *token.Token) {
 	s.scan = nil
 	s.skipBlank()
 	defer s.skipBlank()
+	if s.char == dot && !isLetter(s.peek()) {
+		t.Type = token.Ident
+		t.Literal = string(s.char)
+		s.read()
+		return
+	}
 	if !isLetter(s.char) {
 		t.Type = token.Invalid
 		return
 	}
 	pos := s.curr
-	for isIdent(s.char) {
+	for isIdent(s.char) || (s.char == dot && isLetter(s.peek())) {
 		s.read()
 	}
 	t.Literal = string(s.input[pos:s.curr])
@@ -210,18 +505,65 @@ func (s *Scanner) scanIdent(t *token.Token) {
 		t.Type = token.Bool
 	default:
 		t.Type = token.Ident
+		if kw, ok := blockKeywords[t.Literal]; ok && s.header {
+			t.Type = kw
+		}
 	}
 }
 
 func (s *Scanner) scanOperator(t *token.Token) {
 	t.Type = token.Invalid
-	switch s.char {
+	switch k := s.peek(); s.char {
 	case lparen:
 		t.Type = token.BegGrp
 	case rparen:
 		t.Type = token.EndGrp
 	case pipe:
 		t.Type = token.Pipe
+		if k == pipe {
+			s.read()
+			t.Type = token.Or
+		}
+	case amper:
+		if k == amper {
+			s.read()
+			t.Type = token.And
+		}
+	case comma:
+		t.Type = token.Comma
+	case plus:
+		t.Type = token.Add
+	case dash:
+		t.Type = token.Sub
+	case star:
+		t.Type = token.Mul
+	case slash:
+		t.Type = token.Div
+	case percent:
+		t.Type = token.Mod
+	case equal:
+		if k == equal {
+			s.read()
+			t.Type = token.Eq
+		}
+	case bang:
+		t.Type = token.Not
+		if k == equal {
+			s.read()
+			t.Type = token.Ne
+		}
+	case langle:
+		t.Type = token.Lt
+		if k == equal {
+			s.read()
+			t.Type = token.Le
+		}
+	case rangle:
+		t.Type = token.Gt
+		if k == equal {
+			s.read()
+			t.Type = token.Ge
+		}
 	default:
 	}
 	s.read()
@@ -302,7 +644,7 @@ func (s *Scanner) scanDelim(t *token.Token, accept func() bool) {
 }
 
 func (s *Scanner) scanType(t *token.Token) {
-	s.scan = s.scanIdent
+	s.scan = nil
 	switch s.char {
 	case colon:
 		t.Type = token.Assignment
@@ -320,6 +662,14 @@ func (s *Scanner) scanType(t *token.Token) {
 		t.Type = token.Partial
 	case langle:
 		t.Type = token.Define
+		if s.mustache {
+			t.Type = token.Parent
+		}
+	case dollar:
+		t.Type = token.EscapeVar
+		if s.mustache {
+			t.Type = token.Slot
+		}
 	case arobase:
 		t.Type = token.Exec
 	case percent:
@@ -328,13 +678,39 @@ func (s *Scanner) scanType(t *token.Token) {
 		t.Type = token.End
 	case amper:
 		t.Type = token.UnescapeVar
+	case lbrace:
+		t.Type = token.UnescapeVar
+		s.triple = true
 	default:
 		t.Type = token.EscapeVar
 	}
 	if t.Type != token.EscapeVar {
 		s.read()
 	}
+	s.header = t.Type == token.Block || t.Type == token.Inverted
+	s.skipBlank()
+	if t.Type == token.EscapeVar {
+		s.scanKeyword(t)
+	}
+}
+
+func (s *Scanner) scanKeyword(t *token.Token) {
+	end := s.curr
+	for end < len(s.input) && isIdent(rune(s.input[end])) {
+		end++
+	}
+	if end < len(s.input) && s.input[end] == dot {
+		return
+	}
+	kw, ok := keywords[string(s.input[s.curr:end])]
+	if !ok {
+		return
+	}
+	t.Type = kw
+	t.Literal = string(s.input[s.curr:end])
+	s.skipN(end - s.curr)
 	s.skipBlank()
+	s.scan = nil
 }
 
 func (s *Scanner) read() {
@@ -407,8 +783,40 @@ func (s *Scanner) peek() rune {
 	return r
 }
 
+func isStandaloneTag(tag []byte) bool {
+	if len(tag) == 0 {
+		return false
+	}
+	if string(tag) == raw {
+		return true
+	}
+	switch tag[0] {
+	case pound, caret, slash, bang, rangle, langle, equal, percent, dollar, arobase, colon:
+		return true
+	}
+	var n int
+	for n < len(tag) && isIdent(rune(tag[n])) {
+		n++
+	}
+	switch keywords[string(tag[:n])] {
+	case token.Else, token.Break, token.Continue, token.Extends:
+		return n == len(tag) || tag[n] != dot
+	default:
+		return false
+	}
+}
+
+func isInheritanceTag(r rune) bool {
+	return r == langle || r == dollar || r == slash
+}
+
 func isOperator(r rune) bool {
-	return r == pipe || r == lparen || r == rparen
+	switch r {
+	case pipe, lparen, rparen, comma, amper, plus, dash, star, slash, percent, equal, bang, langle, rangle:
+		return true
+	default:
+		return false
+	}
 }
 
 func isQuote(r rune) bool {
@@ -13,7 +13,7 @@ var tokens = []token.Token{
 	token.CreateToken("", token.Block),
 	token.CreateToken("ident", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\nliteral ", token.Literal),
+	token.CreateToken("literal ", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.EscapeVar),
 	token.CreateToken("escape", token.Ident),
@@ -28,7 +28,6 @@ var tokens = []token.Token{
 	token.CreateToken("", token.End),
 	token.CreateToken("ident", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Inverted),
 	token.CreateToken("falsy", token.Ident),
@@ -43,33 +42,27 @@ var tokens = []token.Token{
 	token.CreateToken("", token.Comment),
 	token.CreateToken("comment", token.Literal),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Delim),
 	token.CreateToken("<%", token.Literal),
 	token.CreateToken("%>", token.Literal),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Partial),
 	token.CreateToken("partial", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Define),
 	token.CreateToken("define", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Exec),
 	token.CreateToken("call", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.Section),
 	token.CreateToken("section", token.Ident),
 	token.CreateToken("", token.Close),
-	token.CreateToken("\n", token.Literal),
 	token.CreateToken("", token.Open),
 	token.CreateToken("", token.EscapeVar),
 	token.CreateToken("text", token.Ident),
@@ -94,6 +87,28 @@ var tokens = []token.Token{
 	token.CreateToken("", token.End),
 	token.CreateToken("block", token.Ident),
 	token.CreateToken("", token.Close),
+	token.CreateToken("\n", token.Literal),
+	token.CreateToken("", token.Open),
+	token.CreateToken("", token.EscapeVar),
+	token.CreateToken("a", token.Ident),
+	token.CreateToken("", token.Ge),
+	token.CreateToken("1", token.Integer),
+	token.CreateToken("", token.And),
+	token.CreateToken("", token.Not),
+	token.CreateToken("", token.BegGrp),
+	token.CreateToken("b", token.Ident),
+	token.CreateToken("", token.Mod),
+	token.CreateToken("2", token.Integer),
+	token.CreateToken("", token.Ne),
+	token.CreateToken("0", token.Integer),
+	token.CreateToken("", token.EndGrp),
+	token.CreateToken("", token.Or),
+	token.CreateToken("c", token.Ident),
+	token.CreateToken("", token.Pipe),
+	token.CreateToken("lower", token.Ident),
+	token.CreateToken("", token.Close),
+	token.CreateToken("\n", token.Literal),
+	token.CreateToken("{{ x }} {{raw}}{{/raw}}\n", token.Literal),
 }
 
 const sample = `
@@ -109,6 +124,10 @@ literal {{escape}} {{&unescape}}
 {{% section}}
 {{text | split "_" | firstn 1 | add 2.3 3.2 }}
 {{#block}}- value{{/block}}
+{{ a >= 1 && !(b % 2 != 0) || c | lower }}
+{{raw}}
+{{ x }} {{raw}}{{/raw}}
+  {{/ raw }}
 `
 
 func TestScanner(t *testing.T) {
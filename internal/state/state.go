@@ -17,21 +17,83 @@ const (
 	KeyRevLoop  = "revloop"
 	KeyRevLoop0 = "revloop0"
 	KeyLength   = "length"
+	KeyIndex    = "index"
+	KeyFirst    = "first"
+	KeyLast     = "last"
+	KeyEven     = "even"
+	KeyOdd      = "odd"
+	KeyParent   = "parent"
 	KeyContext  = "ctx"
 )
 
 type FuncMap map[string]interface{}
 
+type MissingKey int
+
+const (
+	MissingDefault MissingKey = iota
+	MissingZero
+	MissingError
+)
+
+// Formatter gives the string representation of a value.
+type Formatter func(reflect.Value) (string, error)
+
+// Escaper escapes the string representation of values written by templates.
+type Escaper interface {
+	Escape(string) string
+}
+
+// ValueEscaper is an Escaper whose escaping also depends on the value that is
+// written.
+type ValueEscaper interface {
+	Escaper
+	EscapeValue(reflect.Value, string) string
+}
+
+type Options struct {
+	Missing    MissingKey
+	Formatters map[reflect.Type]Formatter
+	Escaper    Escaper
+}
+
 type State interface {
 	Lookup(name string) (reflect.Value, error)
 	Define(name string, value reflect.Value) error
 	Resolve(name string) (reflect.Value, error)
+	Options() Options
+}
+
+// LoopInfo gives the metadata of a loop. It is the value returned by the parent
+// key of a loop and gives access to the metadata of the enclosing loop.
+type LoopInfo struct {
+	Loop     int       `curly:"loop"`
+	Loop0    int       `curly:"loop0"`
+	RevLoop  int       `curly:"revloop"`
+	RevLoop0 int       `curly:"revloop0"`
+	Length   int       `curly:"length"`
+	Index    int       `curly:"index"`
+	First    bool      `curly:"first"`
+	Last     bool      `curly:"last"`
+	Even     bool      `curly:"even"`
+	Odd      bool      `curly:"odd"`
+	Parent   *LoopInfo `curly:"parent"`
+}
+
+type looper interface {
+	currentLoop() *loopState
+}
+
+// finder looks up a name in the data of a state only.
+type finder interface {
+	find(string) (reflect.Value, error)
 }
 
 type loopState struct {
 	State
 	loop   int
 	length int
+	parent *loopState
 }
 
 func Loop(i, n int, parent State) State {
@@ -39,38 +101,132 @@ func Loop(i, n int, parent State) State {
 		State:  parent,
 		loop:   i,
 		length: n,
+		parent: enclosingLoop(parent),
 	}
 }
 
 func (s *loopState) Resolve(name string) (reflect.Value, error) {
-	var value reflect.Value
-	switch name {
-	case KeyLength:
-		value = reflect.ValueOf(s.length)
-	case KeyLoop:
-		value = reflect.ValueOf(s.loop + 1)
-	case KeyLoop0:
-		value = reflect.ValueOf(s.loop)
-	case KeyRevLoop:
-		value = reflect.ValueOf(s.length - s.loop)
-	case KeyRevLoop0:
-		value = reflect.ValueOf((s.length - s.loop) - 1)
-	default:
+	// the data of the element takes precedence over the metadata of the loop
+	if f, ok := s.State.(finder); ok {
+		if v, err := f.find(name); err == nil {
+			return v, nil
+		}
+	}
+	if name == KeyParent {
+		if s.parent == nil {
+			return s.State.Resolve(name)
+		}
+		return reflect.ValueOf(s.parent.info()), nil
+	}
+	value, ok := s.value(name)
+	if !ok {
 		return s.State.Resolve(name)
 	}
-	return value, nil
+	return reflect.ValueOf(value), nil
 }
 
 func (s *loopState) Define(name string, value reflect.Value) error {
+	if _, ok := s.value(name); ok || name == KeyParent {
+		return fmt.Errorf("%s can not be defined", name)
+	}
+	return s.State.Define(name, value)
+}
+
+func (s *loopState) currentLoop() *loopState {
+	return s
+}
+
+func (s *loopState) value(name string) (interface{}, bool) {
+	var value interface{}
 	switch name {
 	case KeyLength:
+		value = s.length
 	case KeyLoop:
-	case KeyLoop0:
+		value = s.loop + 1
+	case KeyLoop0, KeyIndex:
+		value = s.loop
 	case KeyRevLoop:
+		value = s.length - s.loop
 	case KeyRevLoop0:
-		return s.State.Define(name, value)
+		value = (s.length - s.loop) - 1
+	case KeyFirst:
+		value = s.loop == 0
+	case KeyLast:
+		value = s.loop == s.length-1
+	case KeyEven:
+		value = (s.loop+1)%2 == 0
+	case KeyOdd:
+		value = (s.loop+1)%2 == 1
+	default:
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *loopState) info() *LoopInfo {
+	i := LoopInfo{
+		Loop:     s.loop + 1,
+		Loop0:    s.loop,
+		RevLoop:  s.length - s.loop,
+		RevLoop0: (s.length - s.loop) - 1,
+		Length:   s.length,
+		Index:    s.loop,
+		First:    s.loop == 0,
+		Last:     s.loop == s.length-1,
+		Even:     (s.loop+1)%2 == 0,
+		Odd:      (s.loop+1)%2 == 1,
+	}
+	if s.parent != nil {
+		i.Parent = s.parent.info()
+	}
+	return &i
+}
+
+func enclosingLoop(s State) *loopState {
+	if s, ok := s.(looper); ok {
+		return s.currentLoop()
+	}
+	return nil
+}
+
+type scopeState struct {
+	State
+	locals map[string]reflect.Value
+}
+
+// Scope creates a State that holds local variables on top of parent. Names that
+// are not defined locally are resolved by parent.
+func Scope(parent State) State {
+	return &scopeState{
+		State:  parent,
+		locals: make(map[string]reflect.Value),
+	}
+}
+
+func (s *scopeState) Define(name string, value reflect.Value) error {
+	if name == KeyContext {
+		return fmt.Errorf("%s can not be defined", name)
 	}
-	return fmt.Errorf("%s can not be defined", name)
+	s.locals[name] = indirectInterface(value)
+	return nil
+}
+
+func (s *scopeState) currentLoop() *loopState {
+	return enclosingLoop(s.State)
+}
+
+func (s *scopeState) find(name string) (reflect.Value, error) {
+	if v, ok := s.locals[name]; ok {
+		return v, nil
+	}
+	return Invalid, ErrFound
+}
+
+func (s *scopeState) Resolve(name string) (reflect.Value, error) {
+	if v, ok := s.locals[name]; ok {
+		return v, nil
+	}
+	return s.State.Resolve(name)
 }
 
 type stdState struct {
@@ -78,12 +234,19 @@ type stdState struct {
 	current reflect.Value
 	filters map[string]interface{}
 	locals  map[string]reflect.Value
+	options Options
 }
 
 func EmptyState(data interface{}, filters FuncMap) State {
 	return EnclosedState(data, nil, filters)
 }
 
+func NewState(data interface{}, filters FuncMap, options Options) State {
+	s := EnclosedState(data, nil, filters).(*stdState)
+	s.options = options
+	return s
+}
+
 func EnclosedState(data interface{}, parent State, filters FuncMap) State {
 	return &stdState{
 		current: valueOf(data),
@@ -107,6 +270,17 @@ func (s *stdState) Lookup(name string) (reflect.Value, error) {
 	return fn, nil
 }
 
+func (s *stdState) currentLoop() *loopState {
+	return enclosingLoop(s.parent)
+}
+
+func (s *stdState) Options() Options {
+	if s.parent != nil {
+		return s.parent.Options()
+	}
+	return s.options
+}
+
 func (s *stdState) Define(key string, value reflect.Value) error {
 	if key == KeyContext {
 		return fmt.Errorf("%s can not be defined", key)
@@ -120,6 +294,9 @@ func (s *stdState) Resolve(key string) (reflect.Value, error) {
 		return s.current, nil
 	}
 	v, err := s.find(key)
+	if err != nil && !errors.Is(err, ErrFound) {
+		return v, err
+	}
 	if err != nil {
 		if r, ok := s.locals[key]; ok {
 			return r, nil
@@ -128,53 +305,140 @@ func (s *stdState) Resolve(key string) (reflect.Value, error) {
 	if err != nil && s.parent != nil {
 		v, err = s.parent.Resolve(key)
 	}
+	if err != nil && s.Options().Missing == MissingZero {
+		if z := Zero(s.current); z.IsValid() {
+			return z, nil
+		}
+	}
 	return v, err
 }
 
 func (s *stdState) find(key string) (reflect.Value, error) {
-	return s.findWith(key, s.current)
+	return Field(s.current, key)
 }
 
-func (s *stdState) findWith(key string, value reflect.Value) (reflect.Value, error) {
+// Field looks up key in value. Value can be a struct, a map or a pointer/interface
+// on one of these.
+//
+// If value has no field or entry named key, Field calls the method key of value
+// if it takes no argument and returns one value or a value and an error.
+func Field(value reflect.Value, key string) (reflect.Value, error) {
+	var (
+		res reflect.Value
+		err error
+	)
 	switch value.Kind() {
 	case reflect.Struct:
-		return s.lookupStruct(key, value)
+		res, err = lookupStruct(key, value)
 	case reflect.Map:
-		return s.lookupMap(key, value)
-	case reflect.Ptr:
-		return s.findWith(key, value.Elem())
-	case reflect.Interface:
-		return s.findWith(key, reflect.ValueOf(value.Interface()))
+		res, err = lookupMap(key, value)
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return Invalid, fmt.Errorf("%w in nil %s", ErrFound, value.Kind())
+		}
+		res, err = Field(value.Elem(), key)
+	case reflect.Invalid:
+		return Invalid, ErrFound
+	default:
+		err = fmt.Errorf("%w in %s", ErrFound, value.Kind())
 	}
-	return Invalid, ErrFound
+	if err == nil || !errors.Is(err, ErrFound) {
+		return res, err
+	}
+	m := Method(value, key)
+	if !m.IsValid() || m.Type().NumIn() != 0 {
+		return res, err
+	}
+	return Call(m, nil)
+}
+
+// Method gives the method name of value. Methods with a pointer receiver are
+// also available when value is not a pointer. Values reached through an
+// unexported field have no method.
+func Method(value reflect.Value, name string) reflect.Value {
+	if !value.IsValid() || !value.CanInterface() {
+		return Invalid
+	}
+	if k := value.Kind(); k == reflect.Ptr || k == reflect.Interface {
+		return value.MethodByName(name)
+	}
+	if !value.CanAddr() {
+		v := reflect.New(value.Type())
+		v.Elem().Set(value)
+		value = v.Elem()
+	}
+	return value.Addr().MethodByName(name)
+}
+
+// Call calls fn with args. fn should return a single value or a value and an
+// error.
+func Call(fn reflect.Value, args []reflect.Value) (reflect.Value, error) {
+	t := fn.Type()
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return Invalid, fmt.Errorf("%s: unsupported function", t)
+	}
+	rs := fn.Call(args)
+	if len(rs) == 2 && !rs[1].IsNil() {
+		return Invalid, rs[1].Interface().(error)
+	}
+	return indirectInterface(rs[0]), nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Zero gives the zero value of the elements of value if value is a map (or a
+// pointer/interface on a map) of concrete type. It returns Invalid otherwise.
+func Zero(value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.Map:
+		if elem := value.Type().Elem(); elem.Kind() != reflect.Interface {
+			return reflect.Zero(elem)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			break
+		}
+		return Zero(value.Elem())
+	}
+	return Invalid
 }
 
-func (s *stdState) lookupStruct(key string, value reflect.Value) (reflect.Value, error) {
+func lookupStruct(key string, value reflect.Value) (reflect.Value, error) {
 	t := value.Type()
 	for i := 0; i < value.NumField(); i++ {
 		sf := t.Field(i)
 		if sf.Name == key || sf.Tag.Get("curly") == key {
-			return value.Field(i), nil
+			return indirectInterface(value.Field(i)), nil
 		}
 	}
 	return Invalid, ErrFound
 }
 
-func (s *stdState) lookupMap(key string, value reflect.Value) (reflect.Value, error) {
+func lookupMap(key string, value reflect.Value) (reflect.Value, error) {
 	t := value.Type().Key()
-	if !t.AssignableTo(reflect.TypeOf(key)) {
+	if !reflect.TypeOf(key).ConvertibleTo(t) {
 		return Invalid, ErrFound
 	}
-	val := value.MapIndex(reflect.ValueOf(key))
-	if val.IsZero() {
+	val := value.MapIndex(reflect.ValueOf(key).Convert(t))
+	if !val.IsValid() {
 		return Invalid, ErrFound
 	}
-	return val, nil
+	return indirectInterface(val), nil
+}
+
+func indirectInterface(value reflect.Value) reflect.Value {
+	if value.Kind() == reflect.Interface && !value.IsNil() {
+		return value.Elem()
+	}
+	return value
 }
 
 func valueOf(v interface{}) reflect.Value {
 	if v, ok := v.(reflect.Value); ok {
-		return v
+		return indirectInterface(v)
 	}
 	return reflect.ValueOf(v)
 }
@@ -30,12 +30,37 @@ const (
 	End
 	BegGrp
 	EndGrp
+	Else
+	Break
+	Continue
+	Extends
+	Super
+	Parent
+	Slot
+	Add
+	Sub
+	Mul
+	Div
+	Mod
+	Eq
+	Ne
+	Lt
+	Le
+	Gt
+	Ge
+	And
+	Or
+	Not
+	As
+	In
+	Comma
 	Invalid
 )
 
 type Position struct {
 	Line   int
 	Column int
+	Offset int
 }
 
 func (p Position) String() string {
@@ -74,7 +99,7 @@ func (t Token) IsEOF() bool {
 
 func (t Token) IsStructural() bool {
 	switch t.Type {
-	case Open, Close, Delim, Block, Inverted, Pipe, Partial, Section, Define, Exec, End:
+	case Open, Close, Delim, Block, Inverted, Pipe, Partial, Section, Define, Exec, End, Else, Break, Continue, Extends, Super, Parent, Slot:
 		return true
 	default:
 		return false
@@ -131,6 +156,54 @@ func (t Token) String() string {
 		return "<delimiter>"
 	case End:
 		return "<end>"
+	case Else:
+		return "<else>"
+	case Break:
+		return "<break>"
+	case Continue:
+		return "<continue>"
+	case Extends:
+		return "<extends>"
+	case Super:
+		return "<super>"
+	case Parent:
+		return "<parent>"
+	case Slot:
+		return "<slot>"
+	case Add:
+		return "<add>"
+	case Sub:
+		return "<sub>"
+	case Mul:
+		return "<mul>"
+	case Div:
+		return "<div>"
+	case Mod:
+		return "<mod>"
+	case Eq:
+		return "<eq>"
+	case Ne:
+		return "<ne>"
+	case Lt:
+		return "<lt>"
+	case Le:
+		return "<le>"
+	case Gt:
+		return "<gt>"
+	case Ge:
+		return "<ge>"
+	case And:
+		return "<and>"
+	case Or:
+		return "<or>"
+	case Not:
+		return "<not>"
+	case As:
+		return "<as>"
+	case In:
+		return "<in>"
+	case Comma:
+		return "<comma>"
 	case Ident:
 		prefix = "identifier"
 	case Integer:
@@ -0,0 +1,163 @@
+package curly_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/midbel/curly"
+)
+
+//go:generate sh -c "cd testdata/spec && for s in comments delimiters interpolation inverted partials sections '~inheritance' '~lambdas'; do curl -fsSLO https://raw.githubusercontent.com/mustache/spec/v1.3.0/specs/${DOLLAR}s.json || exit 1; done"
+
+type specSuite struct {
+	Overview string     `json:"overview"`
+	Tests    []specTest `json:"tests"`
+}
+
+type specTest struct {
+	Name     string            `json:"name"`
+	Desc     string            `json:"desc"`
+	Data     interface{}       `json:"data"`
+	Template string            `json:"template"`
+	Expected string            `json:"expected"`
+	Partials map[string]string `json:"partials"`
+}
+
+// specSkip lists the cases of the Mustache specification that curly does not
+// conform to yet with the reason why.
+var specSkip = map[string]string{}
+
+// specLambdas gives, per case, the Go implementations of the lambdas given as
+// code in the data of the specification. Cases with lambdas not implemented
+// here are skipped.
+var specLambdas = map[string]func() map[string]interface{}{
+	"~lambdas/Interpolation": func() map[string]interface{} {
+		return lambda(func() string { return "world" })
+	},
+	"~lambdas/Interpolation - Expansion": func() map[string]interface{} {
+		return lambda(func() string { return "{{planet}}" })
+	},
+	"~lambdas/Interpolation - Alternate Delimiters": func() map[string]interface{} {
+		return lambda(func() string { return "|planet| => {{planet}}" })
+	},
+	"~lambdas/Interpolation - Multiple Calls": func() map[string]interface{} {
+		var calls int
+		return lambda(func() string {
+			calls++
+			return strconv.Itoa(calls)
+		})
+	},
+	"~lambdas/Escaping": func() map[string]interface{} {
+		return lambda(func() string { return ">" })
+	},
+	"~lambdas/Section": func() map[string]interface{} {
+		return lambda(func(str string) string {
+			if str == "{{x}}" {
+				return "yes"
+			}
+			return "no"
+		})
+	},
+	"~lambdas/Section - Expansion": func() map[string]interface{} {
+		return lambda(func(str string) string { return str + "{{planet}}" + str })
+	},
+	"~lambdas/Section - Alternate Delimiters": func() map[string]interface{} {
+		return lambda(func(str string) string { return str + "{{planet}} => |planet|" + str })
+	},
+	"~lambdas/Section - Multiple Calls": func() map[string]interface{} {
+		return lambda(func(str string) string { return "__" + str + "__" })
+	},
+	"~lambdas/Inverted Section": func() map[string]interface{} {
+		return lambda(func(string) string { return "" })
+	},
+}
+
+func lambda(fn interface{}) map[string]interface{} {
+	return map[string]interface{}{"lambda": fn}
+}
+
+func TestSpec(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "spec", "*.json"))
+	if err != nil {
+		t.Fatalf("fail to list spec files: %s", err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no spec files found")
+	}
+	for _, f := range files {
+		suite, err := loadSpec(f)
+		if err != nil {
+			t.Errorf("%s: fail to load spec: %s", f, err)
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		t.Run(name, func(t *testing.T) {
+			for _, c := range suite.Tests {
+				c := c
+				t.Run(c.Name, func(t *testing.T) {
+					if why, ok := specSkip[name+"/"+c.Name]; ok {
+						t.Skip(why)
+					}
+					if hasCode(c.Data) {
+						fn, ok := specLambdas[name+"/"+c.Name]
+						if !ok {
+							t.Skip("no Go implementation of the lambdas")
+						}
+						data := c.Data.(map[string]interface{})
+						for k, v := range fn() {
+							data[k] = v
+						}
+					}
+					runSpec(t, c)
+				})
+			}
+		})
+	}
+}
+
+func runSpec(t *testing.T, c specTest) {
+	t.Helper()
+	tpl := curly.New(c.Name).Option("syntax=mustache")
+	for k, p := range c.Partials {
+		if _, err := tpl.New(k).Parse(strings.NewReader(p)); err != nil {
+			t.Fatalf("partial %s: unexpected parse error: %s", k, err)
+		}
+	}
+	if _, err := tpl.Parse(strings.NewReader(c.Template)); err != nil {
+		t.Fatalf("unexpected parse error: %s", err)
+	}
+	var str strings.Builder
+	if err := tpl.Execute(&str, c.Data); err != nil {
+		t.Fatalf("unexpected execute error: %s", err)
+	}
+	if got := str.String(); got != c.Expected {
+		t.Errorf("%s\ntemplate: %q\nwant: %q\ngot:  %q", c.Desc, c.Template, c.Expected, got)
+	}
+}
+
+func loadSpec(file string) (specSuite, error) {
+	var suite specSuite
+	r, err := os.Open(file)
+	if err != nil {
+		return suite, err
+	}
+	defer r.Close()
+	return suite, json.NewDecoder(r).Decode(&suite)
+}
+
+func hasCode(data interface{}) bool {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, v := range m {
+		if c, ok := v.(map[string]interface{}); ok && c["__tag__"] == "code" {
+			return true
+		}
+	}
+	return false
+}